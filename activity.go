@@ -0,0 +1,145 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tbruyelle/hipchat-go/hipchat"
+)
+
+const (
+	// ActivityFromStats measures the activity of a room using the last_active date of its stats, which is updated
+	// by notifications too
+	ActivityFromStats = "stats"
+	// ActivityFromHistory measures the activity of a room using the last message sent by a person in its history
+	ActivityFromHistory = "history"
+)
+
+const (
+	latestHistorySize = 100
+	historyPageSize   = 1000
+	maxHistoryPages   = 5
+)
+
+// GetDaysSinceLastHumanMessage calculates how many days has a room been inactive, based on the history of the room.
+// Notifications and messages from the ignored senders don't count as activity. It returns -1 if nobody ever sent a
+// message to the room.
+func (j *Job) GetDaysSinceLastHumanMessage(roomID int, ignoredSenders []string) (int, error) {
+	lastMessage, found, err := j.GetLastHumanMessage(roomID, ignoredSenders)
+	if err != nil || !found {
+		return -1, err
+	}
+
+	deltaInDays := daysBetween(lastMessage, j.Clock.Now())
+	j.Log.Record("rid", roomID).Debugf("Last human message was %d days ago", deltaInDays)
+	return deltaInDays, nil
+}
+
+// GetLastHumanMessage pages through the history of the room, newest messages first, until it finds a message sent by
+// a person. If the room has more history than we are willing to look at, the date of the oldest message we looked at
+// is returned, since the room has been idle for at least that long.
+func (j *Job) GetLastHumanMessage(roomID int, ignoredSenders []string) (time.Time, bool, error) {
+	id := strconv.Itoa(roomID)
+
+	latest, _, err := j.Client.Room.Latest(id, &hipchat.LatestHistoryOptions{MaxResults: latestHistorySize})
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	lastMessage, oldestMessage := j.scanHistory(roomID, latest.Items, ignoredSenders)
+	if !lastMessage.IsZero() {
+		return lastMessage, true, nil
+	}
+
+	if len(latest.Items) < latestHistorySize {
+		j.Log.Record("rid", roomID).Debugf("No human messages in the history")
+		return time.Time{}, false, nil
+	}
+
+	date := j.Clock.Now().UTC().Format(time.RFC3339)
+	for page := 0; page < maxHistoryPages; page++ {
+		opt := &hipchat.HistoryOptions{
+			ListOptions: hipchat.ListOptions{StartIndex: page * historyPageSize, MaxResults: historyPageSize},
+			Date:        date,
+		}
+
+		history, _, err := j.Client.Room.History(id, opt)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+
+		var oldestInPage time.Time
+		lastMessage, oldestInPage = j.scanHistory(roomID, history.Items, ignoredSenders)
+		if !lastMessage.IsZero() {
+			return lastMessage, true, nil
+		}
+
+		if !oldestInPage.IsZero() && (oldestMessage.IsZero() || oldestInPage.Before(oldestMessage)) {
+			oldestMessage = oldestInPage
+		}
+
+		if history.Links.Next == "" {
+			j.Log.Record("rid", roomID).Debugf("No human messages in the history")
+			return time.Time{}, false, nil
+		}
+	}
+
+	j.Log.Record("rid", roomID).Infof("No human messages in the last %d pages of history, idle since at least %s", maxHistoryPages, oldestMessage)
+	return oldestMessage, !oldestMessage.IsZero(), nil
+}
+
+// scanHistory returns the date of the newest message sent by a person, and the date of the oldest message
+func (j *Job) scanHistory(roomID int, messages []hipchat.Message, ignoredSenders []string) (time.Time, time.Time) {
+	var lastMessage, oldestMessage time.Time
+
+	for _, message := range messages {
+		date, err := time.Parse(time.RFC3339Nano, message.Date)
+		if err != nil {
+			j.Log.Record("rid", roomID).Debugf("Couldn't parse the date of message %s: %v", message.ID, err)
+			continue
+		}
+
+		if oldestMessage.IsZero() || date.Before(oldestMessage) {
+			oldestMessage = date
+		}
+
+		if isHumanMessage(&message, ignoredSenders) && date.After(lastMessage) {
+			lastMessage = date
+		}
+	}
+
+	return lastMessage, oldestMessage
+}
+
+// isHumanMessage returns false for notifications, which are sent by add-ons and integrations, and for messages sent
+// by any of the ignored senders
+func isHumanMessage(message *hipchat.Message, ignoredSenders []string) bool {
+	if message.Type == "notification" {
+		return false
+	}
+
+	sender := senderName(message)
+	for _, ignored := range ignoredSenders {
+		if strings.EqualFold(strings.TrimSpace(ignored), sender) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// senderName returns the name of whoever sent the message. The sender of notifications is a string, while the
+// sender of messages is a user.
+func senderName(message *hipchat.Message) string {
+	switch from := message.From.(type) {
+	case string:
+		return from
+	case map[string]interface{}:
+		if name, ok := from["name"].(string); ok {
+			return name
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tbruyelle/hipchat-go/hipchat"
+)
+
+func TestGetDaysSinceLastHumanMessage(t *testing.T) {
+	now := time.Date(2016, 06, 30, 10, 0, 0, 0, time.UTC)
+	person := map[string]interface{}{"id": 1, "name": "Jane Doe"}
+	bot := map[string]interface{}{"id": 2, "name": "Deploy Bot"}
+
+	message := func(daysAgo int, from interface{}, messageType string) hipchat.Message {
+		date := now.AddDate(0, 0, -daysAgo).Format("2006-01-02T15:04:05.000000+00:00")
+		return hipchat.Message{Date: date, From: from, Type: messageType}
+	}
+
+	notifications := func(count int, daysAgo int) []hipchat.Message {
+		messages := make([]hipchat.Message, count)
+		for i := range messages {
+			messages[i] = message(daysAgo, "CI", "notification")
+		}
+		return messages
+	}
+
+	var historyTests = []struct {
+		history  []hipchat.Message
+		expected int
+	}{
+		{[]hipchat.Message{}, -1},
+		{[]hipchat.Message{message(10, person, "message")}, 10},
+		{[]hipchat.Message{message(10, person, "message"), message(2, "CI", "notification")}, 10},
+		{[]hipchat.Message{message(10, person, "message"), message(2, bot, "message")}, 10},
+		{[]hipchat.Message{message(10, bot, "message"), message(3, person, "message"), message(2, bot, "message")}, 3},
+		{[]hipchat.Message{message(2, "CI", "notification")}, -1},
+		{append([]hipchat.Message{message(20, person, "message")}, notifications(500, 1)...), 20},
+		{append(notifications(1000, 25), notifications(5000, 1)...), 1},
+		{append([]hipchat.Message{message(20, person, "message")}, notifications(6000, 1)...), 1},
+	}
+
+	for _, tt := range historyTests {
+		clock := &testClock{now}
+		hipChat := newFakeHipChat(clock)
+		hipChat.addRoom(hipchat.Room{ID: 1}, hipchat.RoomStatistics{})
+		hipChat.history[1] = tt.history
+
+		job := newTestJob(clock, hipChat)
+		days, err := job.GetDaysSinceLastHumanMessage(1, []string{"deploy bot"})
+		hipChat.server.Close()
+
+		if err != nil || days != tt.expected {
+			t.Error(fmt.Sprintf("GetDaysSinceLastHumanMessage was wrong. Expected=%d Actual=%d Error=%v Messages=%d", tt.expected, days, err, len(tt.history)))
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"bitbucket.org/rbergman/go-hipchat-connect/store"
+	"github.com/tbruyelle/hipchat-go/hipchat"
+)
+
+const (
+	checkpointsStoreKey = "checkpoints"
+	// checkpointInterval is how many rooms are processed between checkpoints
+	checkpointInterval = 50
+	// checkpointTTL is how long a checkpoint is kept, so a job that is never resumed doesn't hold back the next run
+	checkpointTTL = 24 * time.Hour
+	// checkpointRoomsKey is the suffix of the key of the set with the rooms processed by the job
+	checkpointRoomsKey = "rooms"
+)
+
+// Checkpoint is the progress of a job, saved so that it can be resumed if the worker dies before finishing it
+type Checkpoint struct {
+	JobID     string
+	StartedAt time.Time
+	UpdatedAt time.Time
+	// ProcessedRoomIDs are kept in a set of their own, so saving a checkpoint only adds the rooms processed since the
+	// previous one
+	ProcessedRoomIDs []int `json:"-"`
+	Processed        int
+	Archived         int
+	Warned           int
+	// Errors is how many rooms failed. They aren't marked as processed, so a resumed job tries them again.
+	Errors int
+
+	processed map[int]bool
+	// unsaved are the rooms processed since the checkpoint was last saved
+	unsaved []int
+}
+
+// roomSetStore is a store that also keeps sets of room ids
+type roomSetStore interface {
+	store.Store
+	// AddRooms adds the rooms to the set, which expires after sec seconds
+	AddRooms(k string, roomIDs []int, sec int) error
+	Rooms(k string) ([]int, error)
+}
+
+// Checkpoints keeps the checkpoints of the unfinished jobs, one per tenant
+type Checkpoints struct {
+	store roomSetStore
+}
+
+func newCheckpoints(s roomSetStore) *Checkpoints {
+	return &Checkpoints{store: s}
+}
+
+// Get returns the checkpoint of the unfinished job of the tenant, or nil if there isn't one
+func (c *Checkpoints) Get(tenantID string) (*Checkpoint, error) {
+	value, err := c.store.Get(tenantID)
+	if err != nil || len(value) == 0 {
+		return nil, err
+	}
+
+	checkpoint := &Checkpoint{}
+	err = json.Unmarshal(value, checkpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint.ProcessedRoomIDs, err = c.store.Rooms(roomsKey(tenantID))
+	if err != nil {
+		return nil, err
+	}
+
+	return checkpoint, nil
+}
+
+// Set saves the checkpoint of the tenant, which expires after checkpointTTL. Only the rooms processed since it was
+// last saved are written.
+func (c *Checkpoints) Set(tenantID string, checkpoint *Checkpoint) error {
+	value, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	ttl := int(checkpointTTL.Seconds())
+	if len(checkpoint.unsaved) > 0 {
+		if err := c.store.AddRooms(roomsKey(tenantID), checkpoint.unsaved, ttl); err != nil {
+			return err
+		}
+		checkpoint.unsaved = nil
+	}
+
+	return c.store.SetEx(tenantID, value, ttl)
+}
+
+// Del removes the checkpoint of the tenant, once its job is finished
+func (c *Checkpoints) Del(tenantID string) error {
+	if err := c.store.Del(roomsKey(tenantID)); err != nil {
+		return err
+	}
+
+	return c.store.Del(tenantID)
+}
+
+// roomsKey is the key of the set with the rooms processed by the job of the tenant
+func roomsKey(tenantID string) string {
+	return tenantID + ":" + checkpointRoomsKey
+}
+
+// newCheckpoint returns the checkpoint of a job that starts now
+func newCheckpoint(jobID string, now time.Time) *Checkpoint {
+	return &Checkpoint{JobID: jobID, StartedAt: now, UpdatedAt: now}
+}
+
+// isProcessed returns true if the room was processed before the checkpoint was saved
+func (c *Checkpoint) isProcessed(roomID int) bool {
+	if c.processed == nil {
+		c.processed = map[int]bool{}
+		for _, id := range c.ProcessedRoomIDs {
+			c.processed[id] = true
+		}
+	}
+
+	return c.processed[roomID]
+}
+
+// markProcessed records that the room was processed, and counts it
+func (c *Checkpoint) markProcessed(roomID int, archived bool) {
+	c.isProcessed(roomID)
+	c.processed[roomID] = true
+	c.ProcessedRoomIDs = append(c.ProcessedRoomIDs, roomID)
+	c.unsaved = append(c.unsaved, roomID)
+
+	c.Processed++
+	if archived {
+		c.Archived++
+	}
+}
+
+// remaining returns the rooms that weren't processed before the checkpoint was saved
+func (c *Checkpoint) remaining(rooms []hipchat.Room) []hipchat.Room {
+	var remaining []hipchat.Room
+	for _, room := range rooms {
+		if !c.isProcessed(room.ID) {
+			remaining = append(remaining, room)
+		}
+	}
+
+	return remaining
+}
+
+// saveCheckpoint persists the progress of the job. It's a no-op on dry runs, so they don't hold back real runs.
+func (j *Job) saveCheckpoint(checkpoint *Checkpoint) {
+	if j.DryRun || j.Checkpoints == nil {
+		return
+	}
+
+	checkpoint.UpdatedAt = j.Clock.Now()
+	err := j.Checkpoints.Set(j.TenantID, checkpoint)
+	if err != nil {
+		j.Log.Errorf("Couldn't save the checkpoint after %d rooms: %v", checkpoint.Processed, err)
+	}
+}
+
+// finishCheckpoint removes the checkpoint of the job, once all its rooms were processed
+func (j *Job) finishCheckpoint() {
+	if j.DryRun || j.Checkpoints == nil {
+		return
+	}
+
+	err := j.Checkpoints.Del(j.TenantID)
+	if err != nil {
+		j.Log.Errorf("Couldn't remove the checkpoint: %v", err)
+	}
+}
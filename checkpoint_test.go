@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tbruyelle/hipchat-go/hipchat"
+)
+
+func TestResumeFromCheckpoint(t *testing.T) {
+	start := time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC)
+	checkpoints := newCheckpoints(newMemoryStore())
+
+	checkpoint := newCheckpoint("jobId", start)
+	checkpoint.markProcessed(1, false)
+	checkpoint.markProcessed(3, true)
+	checkpoints.Set("tenant", checkpoint)
+
+	resumed, err := checkpoints.Get("tenant")
+	if err != nil || resumed == nil {
+		t.Fatal(fmt.Sprintf("Checkpoint wasn't saved. Error=%v", err))
+	}
+
+	rooms := []hipchat.Room{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 4}}
+	remaining := resumed.remaining(rooms)
+	if resumed.JobID != "jobId" || resumed.Processed != 2 || resumed.Archived != 1 || fmt.Sprint(remaining) != fmt.Sprint([]hipchat.Room{{ID: 2}, {ID: 4}}) {
+		t.Error(fmt.Sprintf("Checkpoint wasn't resumed. Expected=jobId 2/1 rooms 2 and 4 remaining Actual=%s %d/%d %v remaining", resumed.JobID, resumed.Processed, resumed.Archived, remaining))
+	}
+
+	checkpoints.Del("tenant")
+	if finished, _ := checkpoints.Get("tenant"); finished != nil {
+		t.Error(fmt.Sprintf("Checkpoint wasn't removed. Actual=%+v", finished))
+	}
+}
+
+func TestCheckpointOnlyAddsNewRooms(t *testing.T) {
+	start := time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC)
+	r := newFakeRedis(&testClock{start})
+	s := newFakeRedisServer(r)
+
+	lease, _ := s.AcquireTenantLock("tenant", time.Hour)
+	defer lease.Release()
+	checkpoints := newCheckpoints(s.FencedStore(checkpointsStoreKey, lease))
+
+	checkpoint := newCheckpoint("jobId", start)
+	checkpoint.markProcessed(1, false)
+	checkpoint.markProcessed(2, true)
+	if err := checkpoints.Set("tenant", checkpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint.markProcessed(3, false)
+	if len(checkpoint.unsaved) != 1 {
+		t.Errorf("The saved rooms weren't forgotten. Expected=[3] Actual=%v", checkpoint.unsaved)
+	}
+	if err := checkpoints.Set("tenant", checkpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	if value := string(r.values["hipchat:checkpoints:tenant"]); strings.Contains(value, "ProcessedRoomIDs") {
+		t.Errorf("The processed rooms were saved with the checkpoint. Actual=%s", value)
+	}
+
+	resumed, err := checkpoints.Get("tenant")
+	if err != nil || resumed == nil {
+		t.Fatal(fmt.Sprintf("Checkpoint wasn't saved. Error=%v", err))
+	}
+
+	rooms := []hipchat.Room{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 4}}
+	if remaining := resumed.remaining(rooms); resumed.Processed != 3 || fmt.Sprint(remaining) != fmt.Sprint([]hipchat.Room{{ID: 4}}) {
+		t.Error(fmt.Sprintf("Checkpoint wasn't resumed. Expected=3 rooms, room 4 remaining Actual=%d %v remaining", resumed.Processed, remaining))
+	}
+
+	if err := checkpoints.Del("tenant"); err != nil {
+		t.Fatal(err)
+	}
+	if r.exists("hipchat:checkpoints:tenant") || r.exists("hipchat:checkpoints:tenant:rooms") {
+		t.Error("Checkpoint wasn't removed")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DirectiveKind is the kind of a topic directive. Kinds with a higher value take precedence.
+type DirectiveKind int
+
+const (
+	// DirectiveDays archives the room after it has been idle for a number of days, as in [archive:30d]
+	DirectiveDays DirectiveKind = iota
+	// DirectiveOn archives the room on a date, as in [archive:on 2026-12-31]. It's a deadline: the room is archived
+	// from that date on even if it's still used.
+	DirectiveOn
+	// DirectiveNotifyOnly notifies the room instead of archiving it, as in [archive:notify-only]
+	DirectiveNotifyOnly
+	// DirectiveNever never archives the room, as in [archive:never] or the legacy "do not archive"
+	DirectiveNever
+	// DirectiveAfter keeps the room until after a date, as in [archive:after 2026-12-01] or the legacy
+	// "archive-after: 2026-12-01". It doesn't decide what to do with the room from then on, so it's applied on top
+	// of the other directives instead of competing with them.
+	DirectiveAfter
+)
+
+// archiveAfterAlias is the legacy form of [archive:after DATE]
+const archiveAfterAlias = "archive-after:"
+
+var (
+	directiveRegexp     = regexp.MustCompile(`(?i)\[archive:([^\]]*)\]`)
+	directiveDaysRegexp = regexp.MustCompile(`^([0-9]+)d$`)
+)
+
+// TopicDirective is an instruction that the owners of a room leave in its topic to tell us what to do with it
+type TopicDirective struct {
+	Kind DirectiveKind
+	Days int
+	On   time.Time
+	// Text is the directive as written in the topic
+	Text string
+}
+
+// ParseTopicDirectives returns the valid directives of the topic, in the order they are written. Directives that
+// can't be parsed are ignored.
+func ParseTopicDirectives(roomTopic string) []TopicDirective {
+	var directives []TopicDirective
+
+	if strings.Contains(strings.ToLower(roomTopic), topic) {
+		directives = append(directives, TopicDirective{Kind: DirectiveNever, Text: topic})
+	}
+
+	if directive, ok := parseArchiveAfterAlias(roomTopic); ok {
+		directives = append(directives, directive)
+	}
+
+	for _, match := range directiveRegexp.FindAllStringSubmatch(roomTopic, -1) {
+		directive, ok := parseTopicDirective(strings.ToLower(strings.TrimSpace(match[1])))
+		if ok {
+			directive.Text = match[0]
+			directives = append(directives, directive)
+		}
+	}
+
+	return directives
+}
+
+func parseTopicDirective(value string) (TopicDirective, bool) {
+	switch {
+	case value == "never":
+		return TopicDirective{Kind: DirectiveNever}, true
+	case value == "notify-only":
+		return TopicDirective{Kind: DirectiveNotifyOnly}, true
+	case strings.HasPrefix(value, "on "):
+		on, err := time.Parse(dateFormat, strings.TrimSpace(strings.TrimPrefix(value, "on ")))
+		if err != nil {
+			return TopicDirective{}, false
+		}
+		return TopicDirective{Kind: DirectiveOn, On: on}, true
+	case strings.HasPrefix(value, "after "):
+		after, err := time.Parse(dateFormat, strings.TrimSpace(strings.TrimPrefix(value, "after ")))
+		if err != nil {
+			return TopicDirective{}, false
+		}
+		return TopicDirective{Kind: DirectiveAfter, On: after}, true
+	}
+
+	match := directiveDaysRegexp.FindStringSubmatch(value)
+	if match == nil {
+		return TopicDirective{}, false
+	}
+
+	days, err := strconv.Atoi(match[1])
+	if err != nil || days < 1 {
+		return TopicDirective{}, false
+	}
+
+	return TopicDirective{Kind: DirectiveDays, Days: days}, true
+}
+
+// parseArchiveAfterAlias parses the legacy "archive-after: DATE" form of [archive:after DATE]
+func parseArchiveAfterAlias(roomTopic string) (TopicDirective, bool) {
+	s := strings.ToLower(roomTopic)
+
+	i := strings.Index(s, archiveAfterAlias)
+	if i == -1 {
+		return TopicDirective{}, false
+	}
+
+	fields := strings.Fields(s[i+len(archiveAfterAlias):])
+	if len(fields) == 0 {
+		return TopicDirective{}, false
+	}
+
+	directive, ok := parseTopicDirective("after " + fields[0])
+	directive.Text = archiveAfterAlias + " " + fields[0]
+	return directive, ok
+}
+
+// TopicArchiveAfter returns the first [archive:after DATE] directive of the topic, or its legacy alias. It returns
+// false if the topic doesn't keep the room until a date.
+func TopicArchiveAfter(roomTopic string) (TopicDirective, bool) {
+	for _, directive := range ParseTopicDirectives(roomTopic) {
+		if directive.Kind == DirectiveAfter {
+			return directive, true
+		}
+	}
+
+	return TopicDirective{}, false
+}
+
+// EffectiveTopicDirective returns the directive of the topic that applies to the room. never takes precedence over
+// notify-only, which takes precedence over on a date, which takes precedence over a number of days. When there are
+// several directives of the same kind the first one applies. [archive:after DATE] is left to TopicArchiveAfter. It
+// returns false if the topic has no valid directives.
+func EffectiveTopicDirective(roomTopic string) (TopicDirective, bool) {
+	var effective TopicDirective
+	found := false
+
+	for _, directive := range ParseTopicDirectives(roomTopic) {
+		if directive.Kind == DirectiveAfter {
+			continue
+		}
+
+		if !found || directive.Kind > effective.Kind {
+			effective = directive
+			found = true
+		}
+	}
+
+	return effective, found
+}
+
+// decision returns what to do with the room according to the directive. threshold is the threshold that applies to
+// the room otherwise, which notify-only keeps. Rooms with a date are left alone until then, and archived from then on
+// however recently they were used.
+func (d TopicDirective) decision(now time.Time, threshold int) Decision {
+	reason := fmt.Sprintf("topic directive '%s'", d.Text)
+
+	switch d.Kind {
+	case DirectiveNever:
+		return Decision{Action: ActionNever, Reason: reason}
+	case DirectiveNotifyOnly:
+		return Decision{Action: ActionNotify, Threshold: threshold, Reason: reason}
+	case DirectiveOn:
+		if now.Before(d.On) {
+			return Decision{Action: ActionNever, Reason: reason}
+		}
+		return Decision{Action: ActionArchive, Threshold: 0, Reason: "deadline of " + reason}
+	}
+
+	return Decision{Action: ActionArchive, Threshold: d.Days, Reason: reason}
+}
+
+// applyTopicDirective replaces the decision with the one of the directive in the topic of the room, if any
+func (j *Job) applyTopicDirective(roomID int, roomTopic string, decision Decision) Decision {
+	directive, ok := EffectiveTopicDirective(roomTopic)
+	if !ok {
+		return decision
+	}
+
+	topicDecision := directive.decision(j.Clock.Now(), decision.Threshold)
+	if directive.Kind == DirectiveOn && topicDecision.Action == ActionArchive {
+		j.Log.Record("rid", roomID).Infof("Archiving regardless of its activity, the %s passed on %s", topicDecision.Reason, directive.On.Format(dateFormat))
+		return topicDecision
+	}
+
+	j.Log.Record("rid", roomID).Infof("Applying %s instead of %s", topicDecision.Reason, decision.Reason)
+	return topicDecision
+}
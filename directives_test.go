@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestEffectiveTopicDirective(t *testing.T) {
+	var directiveTests = []struct {
+		topic string
+		found bool
+		kind  DirectiveKind
+		days  int
+		text  string
+	}{
+		{"", false, DirectiveDays, 0, ""},
+		{"Just a topic", false, DirectiveDays, 0, ""},
+		{"Launch [archive:30d]", true, DirectiveDays, 30, "[archive:30d]"},
+		{"Launch [ARCHIVE: 7D ]", true, DirectiveDays, 7, "[ARCHIVE: 7D ]"},
+		{"Launch [archive:0d]", false, DirectiveDays, 0, ""},
+		{"Launch [archive:soon]", false, DirectiveDays, 0, ""},
+		{"Launch [archive:on 2026-12-31]", true, DirectiveOn, 0, "[archive:on 2026-12-31]"},
+		{"Launch [archive:on 31/12/2026]", false, DirectiveDays, 0, ""},
+		{"Launch [archive:notify-only]", true, DirectiveNotifyOnly, 0, "[archive:notify-only]"},
+		{"Launch [archive:never]", true, DirectiveNever, 0, "[archive:never]"},
+		{"Launch | Do Not Archive", true, DirectiveNever, 0, "do not archive"},
+		{"[archive:30d] [archive:7d]", true, DirectiveDays, 30, "[archive:30d]"},
+		{"[archive:30d] [archive:on 2026-12-31]", true, DirectiveOn, 0, "[archive:on 2026-12-31]"},
+		{"[archive:on 2026-12-31] [archive:notify-only]", true, DirectiveNotifyOnly, 0, "[archive:notify-only]"},
+		{"[archive:notify-only] [archive:never] [archive:30d]", true, DirectiveNever, 0, "[archive:never]"},
+		{"[archive:after 2026-12-01]", false, DirectiveDays, 0, ""},
+		{"[archive:after 2026-12-01] [archive:7d]", true, DirectiveDays, 7, "[archive:7d]"},
+	}
+
+	for _, tt := range directiveTests {
+		directive, found := EffectiveTopicDirective(tt.topic)
+		if found != tt.found || (found && (directive.Kind != tt.kind || directive.Days != tt.days || directive.Text != tt.text)) {
+			t.Error(fmt.Sprintf("EffectiveTopicDirective was wrong. Expected=%v %+v Actual=%v %+v Topic=%s", tt.found, TopicDirective{Kind: tt.kind, Days: tt.days, Text: tt.text}, found, directive, tt.topic))
+		}
+	}
+}
+
+func TestTopicDirectiveDecision(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	var decisionTests = []struct {
+		topic     string
+		action    PolicyAction
+		threshold int
+	}{
+		{"[archive:30d]", ActionArchive, 30},
+		{"[archive:never]", ActionNever, 0},
+		{"[archive:notify-only]", ActionNotify, 90},
+		{"[archive:on 2026-12-31]", ActionNever, 0},
+		{"[archive:on 2026-10-18]", ActionArchive, 0},
+		{"[archive:on 2026-01-01]", ActionArchive, 0},
+	}
+
+	for _, tt := range decisionTests {
+		directive, _ := EffectiveTopicDirective(tt.topic)
+		decision := directive.decision(now, 90)
+		if decision.Action != tt.action || decision.Threshold != tt.threshold {
+			t.Error(fmt.Sprintf("Directive decision was wrong. Expected=%s/%d Actual=%s/%d Topic=%s", tt.action, tt.threshold, decision.Action, decision.Threshold, tt.topic))
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"bitbucket.org/rbergman/go-hipchat-connect/store"
+)
+
+const dryRunReportsStoreKey = "dry-runs"
+
+// isDryRun returns true if the jobs of the tenant shouldn't change anything at the given time
+func (t *TenantConfiguration) isDryRun(now time.Time) bool {
+	if !t.DryRun {
+		return false
+	}
+
+	until, err := time.Parse(dateFormat, t.DryRunUntil)
+	if err != nil {
+		// An invalid date can't end the dry run
+		return true
+	}
+
+	return now.Before(until.AddDate(0, 0, 1))
+}
+
+// validateDryRunUntil returns an error if the end of the dry run is not a valid date
+func (t *TenantConfiguration) validateDryRunUntil() error {
+	if t.DryRunUntil == "" {
+		return nil
+	}
+
+	if _, err := time.Parse(dateFormat, t.DryRunUntil); err != nil {
+		return fmt.Errorf("Dry run end '%s' is not YYYY-MM-DD", t.DryRunUntil)
+	}
+
+	return nil
+}
+
+// DryRunReport is what the last dry run of a tenant would have done, for the admin to review before going live
+type DryRunReport struct {
+	JobID        string
+	FinishedAt   time.Time
+	Processed    int
+	Archived     int
+	Warned       int
+	WouldArchive []RoomSummary
+}
+
+// DryRunReports keeps the report of the last dry run of every tenant
+type DryRunReports struct {
+	store store.Store
+}
+
+func (s *Server) NewDryRunReports() *DryRunReports {
+	return newDryRunReports(s.NewTenantStore(dryRunReportsStoreKey))
+}
+
+func newDryRunReports(s store.Store) *DryRunReports {
+	return &DryRunReports{store: s}
+}
+
+// Get returns the report of the last dry run of the tenant, or nil if it never had one
+func (d *DryRunReports) Get(tenantID string) (*DryRunReport, error) {
+	value, err := d.store.Get(tenantID)
+	if err != nil || len(value) == 0 {
+		return nil, err
+	}
+
+	report := &DryRunReport{}
+	err = json.Unmarshal(value, report)
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// Set replaces the report of the last dry run of the tenant
+func (d *DryRunReports) Set(tenantID string, report *DryRunReport) error {
+	value, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	return d.store.Set(tenantID, value)
+}
+
+// newDryRunReport returns the report of the job that the summary is about
+func newDryRunReport(summary *JobSummary, finishedAt time.Time) *DryRunReport {
+	return &DryRunReport{
+		JobID:        summary.JobID,
+		FinishedAt:   finishedAt,
+		Processed:    summary.Processed,
+		Archived:     summary.Archived,
+		Warned:       summary.Warned,
+		WouldArchive: summary.WouldArchive,
+	}
+}
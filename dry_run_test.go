@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tbruyelle/hipchat-go/hipchat"
+)
+
+func TestIsDryRun(t *testing.T) {
+	now := time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC)
+
+	var dryRunTests = []struct {
+		configuration TenantConfiguration
+		dryRun        bool
+		valid         bool
+	}{
+		{TenantConfiguration{}, false, true},
+		{TenantConfiguration{DryRunUntil: "2016-06-30"}, false, true},
+		{TenantConfiguration{DryRun: true}, true, true},
+		{TenantConfiguration{DryRun: true, DryRunUntil: "2016-06-01"}, true, true},
+		{TenantConfiguration{DryRun: true, DryRunUntil: "2016-05-31"}, false, true},
+		{TenantConfiguration{DryRun: true, DryRunUntil: "tomorrow"}, true, false},
+	}
+
+	for _, tt := range dryRunTests {
+		if dryRun := tt.configuration.isDryRun(now); dryRun != tt.dryRun {
+			t.Error(fmt.Sprintf("isDryRun was wrong. Expected=%v Actual=%v Configuration=%+v", tt.dryRun, dryRun, tt.configuration))
+		}
+
+		if err := tt.configuration.validateDryRunUntil(); (err == nil) != tt.valid {
+			t.Error(fmt.Sprintf("validateDryRunUntil was wrong. Expected valid=%v Actual=%v Configuration=%+v", tt.valid, err, tt.configuration))
+		}
+	}
+}
+
+func TestDryRunRecordsWarnedRooms(t *testing.T) {
+	start := time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC)
+	clock := &testClock{start}
+	hipChat := newFakeHipChat(clock)
+	defer hipChat.server.Close()
+
+	hipChat.addRoom(hipchat.Room{ID: 1, Name: "idle"}, hipchat.RoomStatistics{})
+	hipChat.setLastActive(1, start.AddDate(0, 0, -20))
+	hipChat.addRoom(hipchat.Room{ID: 2, Name: "close"}, hipchat.RoomStatistics{})
+	hipChat.setLastActive(2, start.AddDate(0, 0, -8))
+
+	job := newTestJob(clock, hipChat)
+	job.DryRun = true
+	configuration := &TenantConfiguration{Threshold: 10, WarningDays: 3}
+
+	// Dry runs don't remember the warnings, so every run is like the first one
+	for day := 0; day < 5; day++ {
+		job.wouldArchive = nil
+		clock.time = start.AddDate(0, 0, day)
+		rooms, _ := job.GetRooms()
+		job.processRooms(rooms, configuration, nil)
+	}
+
+	archived := map[int]RoomSummary{}
+	for _, room := range job.wouldArchive {
+		archived[room.RoomID] = room
+	}
+
+	if len(archived) != 2 || archived[1] != (RoomSummary{1, "idle", 24, true}) || archived[2] != (RoomSummary{2, "close", 12, true}) {
+		t.Error(fmt.Sprintf("Dry run didn't record the rooms. Expected=rooms 1 and 2 after a warning Actual=%+v", job.wouldArchive))
+	}
+
+	if len(hipChat.notifications) != 0 {
+		t.Error(fmt.Sprintf("Dry run notified the rooms. Actual=%v", hipChat.notifications))
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/rbergman/go-hipchat-connect/web"
+	"github.com/chakrit/go-bunyan"
+	"github.com/garyburd/redigo/redis"
+	"github.com/go-zoo/bone"
+)
+
+// fakeRedis is an in memory Redis with the commands and the scripts that the server uses. Keys expire according to
+// its clock.
+type fakeRedis struct {
+	sync.Mutex
+	clock   *testClock
+	values  map[string][]byte
+	sets    map[string]map[string]bool
+	expires map[string]time.Time
+	// cursors are the last values returned by the scans, so they resume after them like Redis does, even if values
+	// are added meanwhile
+	cursors []string
+}
+
+func newFakeRedis(clock *testClock) *fakeRedis {
+	return &fakeRedis{
+		clock:   clock,
+		values:  map[string][]byte{},
+		sets:    map[string]map[string]bool{},
+		expires: map[string]time.Time{},
+	}
+}
+
+// newFakeRedisServer returns a server whose Redis is the fake
+func newFakeRedisServer(r *fakeRedis) *Server {
+	return &Server{Server: web.Server{
+		Log:    bunyan.NewStdLogger("test", bunyan.NilSink()),
+		Router: bone.New(),
+		RedisPool: &redis.Pool{
+			MaxIdle: 3,
+			Dial:    func() (redis.Conn, error) { return &fakeRedisConn{r}, nil },
+		},
+	}}
+}
+
+// advance moves the clock of the fake forward, expiring the keys
+func (r *fakeRedis) advance(d time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+	r.clock.time = r.clock.time.Add(d)
+}
+
+type fakeRedisConn struct {
+	redis *fakeRedis
+}
+
+func (c *fakeRedisConn) Close() error { return nil }
+func (c *fakeRedisConn) Err() error   { return nil }
+func (c *fakeRedisConn) Flush() error { return nil }
+
+func (c *fakeRedisConn) Send(commandName string, args ...interface{}) error {
+	return fmt.Errorf("fakeRedis doesn't pipeline commands")
+}
+
+func (c *fakeRedisConn) Receive() (interface{}, error) {
+	return nil, fmt.Errorf("fakeRedis doesn't pipeline commands")
+}
+
+func (c *fakeRedisConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	if commandName == "" {
+		return nil, nil
+	}
+
+	strArgs := make([]string, len(args))
+	for i, arg := range args {
+		if b, ok := arg.([]byte); ok {
+			strArgs[i] = string(b)
+		} else {
+			strArgs[i] = fmt.Sprint(arg)
+		}
+	}
+
+	c.redis.Lock()
+	defer c.redis.Unlock()
+	return c.redis.do(strings.ToUpper(commandName), strArgs)
+}
+
+// expire forgets the key if it expired
+func (r *fakeRedis) expire(key string) {
+	if at, ok := r.expires[key]; ok && !r.clock.Now().Before(at) {
+		delete(r.values, key)
+		delete(r.sets, key)
+		delete(r.expires, key)
+	}
+}
+
+func (r *fakeRedis) exists(key string) bool {
+	r.expire(key)
+	_, isValue := r.values[key]
+	_, isSet := r.sets[key]
+	return isValue || isSet
+}
+
+func (r *fakeRedis) do(command string, args []string) (interface{}, error) {
+	for _, arg := range args {
+		r.expire(arg)
+	}
+
+	switch command {
+	case "GET":
+		if value, ok := r.values[args[0]]; ok {
+			return value, nil
+		}
+		return nil, nil
+	case "SET":
+		return r.set(args)
+	case "DEL":
+		deleted := int64(0)
+		for _, key := range args {
+			if r.exists(key) {
+				deleted++
+			}
+			delete(r.values, key)
+			delete(r.sets, key)
+			delete(r.expires, key)
+		}
+		return deleted, nil
+	case "INCR":
+		value, _ := strconv.ParseInt(string(r.values[args[0]]), 10, 64)
+		value++
+		r.values[args[0]] = []byte(strconv.FormatInt(value, 10))
+		return value, nil
+	case "TTL":
+		if !r.exists(args[0]) {
+			return int64(-2), nil
+		} else if at, ok := r.expires[args[0]]; ok {
+			return int64(at.Sub(r.clock.Now()) / time.Second), nil
+		}
+		return int64(-1), nil
+	case "PEXPIRE":
+		if !r.exists(args[0]) {
+			return int64(0), nil
+		}
+		ms, _ := strconv.Atoi(args[1])
+		r.expires[args[0]] = r.clock.Now().Add(time.Duration(ms) * time.Millisecond)
+		return int64(1), nil
+	case "SADD":
+		if r.sets[args[0]] == nil {
+			r.sets[args[0]] = map[string]bool{}
+		}
+		added := int64(0)
+		for _, member := range args[1:] {
+			if !r.sets[args[0]][member] {
+				r.sets[args[0]][member] = true
+				added++
+			}
+		}
+		return added, nil
+	case "SREM":
+		removed := int64(0)
+		for _, member := range args[1:] {
+			if r.sets[args[0]][member] {
+				delete(r.sets[args[0]], member)
+				removed++
+			}
+		}
+		return removed, nil
+	case "SISMEMBER":
+		if r.sets[args[0]][args[1]] {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case "SMEMBERS":
+		var members []interface{}
+		for member := range r.sets[args[0]] {
+			members = append(members, []byte(member))
+		}
+		return members, nil
+	case "SRANDMEMBER":
+		count, _ := strconv.Atoi(args[1])
+		var members []interface{}
+		for member := range r.sets[args[0]] {
+			if len(members) == count {
+				break
+			}
+			members = append(members, []byte(member))
+		}
+		return members, nil
+	case "EXPIRE":
+		if !r.exists(args[0]) {
+			return int64(0), nil
+		}
+		sec, _ := strconv.Atoi(args[1])
+		r.expires[args[0]] = r.clock.Now().Add(time.Duration(sec) * time.Second)
+		return int64(1), nil
+	case "SSCAN":
+		var members []string
+		for member := range r.sets[args[0]] {
+			members = append(members, member)
+		}
+		return r.scan(members, args[1:])
+	case "SCAN":
+		for key := range r.expires {
+			r.expire(key)
+		}
+		var keys []string
+		for key := range r.values {
+			keys = append(keys, key)
+		}
+		for key := range r.sets {
+			keys = append(keys, key)
+		}
+		return r.scan(keys, args)
+	case "EVALSHA":
+		return nil, redis.Error("NOSCRIPT No matching script")
+	case "EVAL":
+		return r.eval(args)
+	}
+
+	return nil, fmt.Errorf("fakeRedis doesn't know %s", command)
+}
+
+// set runs SET key value [NX] [EX seconds|PX milliseconds]
+func (r *fakeRedis) set(args []string) (interface{}, error) {
+	key := args[0]
+	var expiresAt time.Time
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			if r.exists(key) {
+				return nil, nil
+			}
+		case "EX", "PX":
+			n, _ := strconv.Atoi(args[i+1])
+			unit := time.Second
+			if strings.ToUpper(args[i]) == "PX" {
+				unit = time.Millisecond
+			}
+			expiresAt = r.clock.Now().Add(time.Duration(n) * unit)
+			i++
+		}
+	}
+
+	r.values[key] = []byte(args[1])
+	delete(r.expires, key)
+	if !expiresAt.IsZero() {
+		r.expires[key] = expiresAt
+	}
+
+	return "OK", nil
+}
+
+// scan returns a page of the sorted values after the cursor, as SCAN and SSCAN do. MATCH and COUNT are supported.
+func (r *fakeRedis) scan(values []string, args []string) (interface{}, error) {
+	cursor, _ := strconv.Atoi(args[0])
+	count, match := 10, "*"
+	for i := 1; i+1 < len(args); i += 2 {
+		switch strings.ToUpper(args[i]) {
+		case "COUNT":
+			count, _ = strconv.Atoi(args[i+1])
+		case "MATCH":
+			match = args[i+1]
+		}
+	}
+
+	sort.Strings(values)
+	start := 0
+	if cursor > 0 {
+		start = sort.SearchStrings(values, r.cursors[cursor-1])
+		if start < len(values) && values[start] == r.cursors[cursor-1] {
+			start++
+		}
+	}
+
+	end := start + count
+	if end >= len(values) {
+		end = len(values)
+	}
+
+	var page []interface{}
+	for _, value := range values[start:end] {
+		if ok, _ := path.Match(match, value); ok {
+			page = append(page, []byte(value))
+		}
+	}
+
+	next := 0
+	if end < len(values) {
+		r.cursors = append(r.cursors, values[end-1])
+		next = len(r.cursors)
+	}
+
+	return []interface{}{[]byte(strconv.Itoa(next)), page}, nil
+}
+
+// eval runs the scripts of the server, recognized by the commands they call
+func (r *fakeRedis) eval(args []string) (interface{}, error) {
+	script := args[0]
+	numKeys, _ := strconv.Atoi(args[1])
+	keys, argv := args[2:2+numKeys], args[2+numKeys:]
+
+	switch {
+	case strings.Contains(script, "INCR"):
+		if ok, _ := r.set([]string{keys[0], argv[0], "NX", "PX", argv[1]}); ok == nil {
+			return int64(0), nil
+		}
+		return r.do("INCR", keys[1:])
+	case strings.Contains(script, "PEXPIRE"):
+		if string(r.values[keys[0]]) != argv[0] {
+			return int64(0), nil
+		}
+		return r.do("PEXPIRE", []string{keys[0], argv[1]})
+	case strings.Contains(script, `"SET", KEYS[2]`):
+		if string(r.values[keys[0]]) != argv[0] {
+			return int64(0), nil
+		}
+		if argv[2] == "0" {
+			r.set([]string{keys[1], argv[1]})
+		} else {
+			r.set([]string{keys[1], argv[1], "EX", argv[2]})
+		}
+		return int64(1), nil
+	case strings.Contains(script, `"SADD", KEYS[2]`):
+		if string(r.values[keys[0]]) != argv[0] {
+			return int64(0), nil
+		}
+		r.do("SADD", append([]string{keys[1]}, argv[2:]...))
+		r.do("EXPIRE", []string{keys[1], argv[1]})
+		return int64(1), nil
+	case strings.Contains(script, `"DEL", KEYS[2]`):
+		if string(r.values[keys[0]]) != argv[0] {
+			return int64(0), nil
+		}
+		r.do("DEL", keys[1:])
+		return int64(1), nil
+	case strings.Contains(script, "DEL"):
+		if string(r.values[keys[0]]) != argv[0] {
+			return int64(0), nil
+		}
+		return r.do("DEL", keys)
+	}
+
+	return nil, fmt.Errorf("fakeRedis doesn't know the script %s", script)
+}
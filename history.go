@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"bitbucket.org/rbergman/go-hipchat-connect/store"
+	"bitbucket.org/rbergman/go-hipchat-connect/util"
+	"github.com/tbruyelle/hipchat-go/hipchat"
+)
+
+const (
+	historyStoreKey        = "history"
+	historyEntriesStoreKey = "history-entries"
+	// defaultHistoryRetentionDays is how long the jobs are kept, unless HISTORY_RETENTION_DAYS says otherwise
+	defaultHistoryRetentionDays = 90
+)
+
+// JobRecord is a job that processed the rooms of a tenant, as kept in its history
+type JobRecord struct {
+	JobID       string
+	StartedAt   time.Time
+	FinishedAt  time.Time
+	Processed   int
+	Archived    int
+	Warned      int
+	Errors      int
+	DryRun      bool
+	Interrupted bool   `json:",omitempty"`
+	Error       string `json:",omitempty"`
+}
+
+// AuditEntry is something a job did to a room, and why
+type AuditEntry struct {
+	RoomID   int
+	Name     string
+	Action   string
+	Reason   string
+	IdleDays int
+	At       time.Time
+}
+
+// JobHistory keeps the jobs of every tenant, and what they did to each room, for a retention period
+type JobHistory struct {
+	jobs      store.Store
+	entries   store.Store
+	retention time.Duration
+}
+
+func (s *Server) NewJobHistory() *JobHistory {
+	retentionDays := util.Env.GetIntOr("HISTORY_RETENTION_DAYS", defaultHistoryRetentionDays)
+	return newJobHistory(s.NewTenantStore(historyStoreKey), s.NewTenantStore(historyEntriesStoreKey), time.Duration(retentionDays)*24*time.Hour)
+}
+
+func newJobHistory(jobs store.Store, entries store.Store, retention time.Duration) *JobHistory {
+	return &JobHistory{jobs: jobs, entries: entries, retention: retention}
+}
+
+// Jobs returns the jobs of the tenant that finished during the retention period, the newest first
+func (h *JobHistory) Jobs(tenantID string, now time.Time) ([]JobRecord, error) {
+	value, err := h.jobs.Get(tenantID)
+	if err != nil || len(value) == 0 {
+		return nil, err
+	}
+
+	var records []JobRecord
+	err = json.Unmarshal(value, &records)
+	if err != nil {
+		return nil, err
+	}
+
+	var kept []JobRecord
+	for _, record := range records {
+		if now.Sub(record.FinishedAt) < h.retention {
+			kept = append(kept, record)
+		}
+	}
+
+	return kept, nil
+}
+
+// Entries returns what the job did to the rooms of the tenant, or nothing if the job expired
+func (h *JobHistory) Entries(tenantID string, jobID string) ([]AuditEntry, error) {
+	value, err := h.entries.Get(tenantID + ":" + jobID)
+	if err != nil || len(value) == 0 {
+		return nil, err
+	}
+
+	var entries []AuditEntry
+	err = json.Unmarshal(value, &entries)
+	return entries, err
+}
+
+// Add records a job of the tenant and its entries. A resumed job replaces its previous record, and its entries are
+// added to the ones recorded before it was interrupted.
+func (h *JobHistory) Add(tenantID string, record JobRecord, entries []AuditEntry) error {
+	previous, err := h.Entries(tenantID, record.JobID)
+	if err != nil {
+		return err
+	}
+
+	value, err := json.Marshal(append(previous, entries...))
+	if err != nil {
+		return err
+	}
+
+	ttl := int(h.retention.Seconds())
+	err = h.entries.SetEx(tenantID+":"+record.JobID, value, ttl)
+	if err != nil {
+		return err
+	}
+
+	records, err := h.Jobs(tenantID, record.FinishedAt)
+	if err != nil {
+		return err
+	}
+
+	updated := []JobRecord{record}
+	for _, r := range records {
+		if r.JobID != record.JobID {
+			updated = append(updated, r)
+		}
+	}
+
+	value, err = json.Marshal(updated)
+	if err != nil {
+		return err
+	}
+
+	return h.jobs.SetEx(tenantID, value, ttl)
+}
+
+// newJobRecord returns the record of the job that the summary is about
+func newJobRecord(summary *JobSummary, startedAt time.Time, finishedAt time.Time) JobRecord {
+	return JobRecord{
+		JobID:       summary.JobID,
+		StartedAt:   startedAt,
+		FinishedAt:  finishedAt,
+		Processed:   summary.Processed,
+		Archived:    summary.Archived,
+		Warned:      summary.Warned,
+		Errors:      summary.Errors,
+		DryRun:      summary.DryRun,
+		Interrupted: summary.Interrupted,
+		Error:       summary.Error,
+	}
+}
+
+// auditActions are the outcomes that are recorded in the history, and how they are called there
+var auditActions = map[roomOutcome]string{
+	roomArchived: "archived",
+	roomWarned:   "warned",
+	roomNotified: "notified",
+	roomTouched:  "touched",
+}
+
+// recordAudit remembers what the job did to the room, if it did something
+func (j *Job) recordAudit(room *hipchat.Room, outcome roomOutcome, reason string, idleDays int) {
+	action, ok := auditActions[outcome]
+	if !ok {
+		return
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.audit = append(j.audit, AuditEntry{RoomID: room.ID, Name: room.Name, Action: action, Reason: reason, IdleDays: idleDays, At: j.Clock.Now()})
+}
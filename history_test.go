@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tbruyelle/hipchat-go/hipchat"
+)
+
+func TestJobHistory(t *testing.T) {
+	start := time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC)
+	history := newJobHistory(newMemoryStore(), newMemoryStore(), 30*24*time.Hour)
+
+	history.Add("tenant", JobRecord{JobID: "old", FinishedAt: start.AddDate(0, 0, -40)}, nil)
+	history.Add("tenant", JobRecord{JobID: "first", FinishedAt: start, Processed: 1}, []AuditEntry{{RoomID: 1, Action: "warned"}})
+	// The job is resumed after being interrupted
+	history.Add("tenant", JobRecord{JobID: "second", FinishedAt: start.Add(time.Hour), Processed: 1, Interrupted: true}, []AuditEntry{{RoomID: 2, Action: "archived"}})
+	history.Add("tenant", JobRecord{JobID: "second", FinishedAt: start.Add(2 * time.Hour), Processed: 2}, []AuditEntry{{RoomID: 3, Action: "archived"}})
+
+	jobs, err := history.Jobs("tenant", start.Add(3*time.Hour))
+	if err != nil || len(jobs) != 2 || jobs[0].JobID != "second" || jobs[0].Processed != 2 || jobs[0].Interrupted || jobs[1].JobID != "first" {
+		t.Error(fmt.Sprintf("Jobs weren't kept. Expected=second and first Actual=%+v Error=%v", jobs, err))
+	}
+
+	entries, err := history.Entries("tenant", "second")
+	if err != nil || len(entries) != 2 || entries[0].RoomID != 2 || entries[1].RoomID != 3 {
+		t.Error(fmt.Sprintf("Entries of the resumed job weren't kept. Expected=rooms 2 and 3 Actual=%+v Error=%v", entries, err))
+	}
+
+	if jobs, _ := history.Jobs("tenant", start.AddDate(0, 0, 31)); len(jobs) != 0 {
+		t.Error(fmt.Sprintf("Jobs weren't expired. Actual=%+v", jobs))
+	}
+}
+
+func TestAuditEntries(t *testing.T) {
+	start := time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC)
+	clock := &testClock{start}
+	hipChat := newFakeHipChat(clock)
+	defer hipChat.server.Close()
+
+	hipChat.addRoom(hipchat.Room{ID: 1, Name: "idle"}, hipchat.RoomStatistics{})
+	hipChat.setLastActive(1, start.AddDate(0, 0, -20))
+	hipChat.addRoom(hipchat.Room{ID: 2, Name: "close"}, hipchat.RoomStatistics{})
+	hipChat.setLastActive(2, start.AddDate(0, 0, -8))
+	hipChat.addRoom(hipchat.Room{ID: 3, Name: "active"}, hipchat.RoomStatistics{})
+	hipChat.setLastActive(3, start)
+
+	job := newTestJob(clock, hipChat)
+	configuration := &TenantConfiguration{Threshold: 10, WarningDays: 3}
+	overrides := map[int]RoomOverride{1: {RoomID: 1, Threshold: 15}}
+	job.States.Set(1, &RoomState{WarnedAt: start.AddDate(0, 0, -5)})
+
+	rooms, _ := job.GetRooms()
+	job.processRooms(rooms, configuration, overrides)
+
+	entries := map[int]AuditEntry{}
+	for _, entry := range job.audit {
+		entries[entry.RoomID] = entry
+	}
+
+	expected := map[int]AuditEntry{
+		1: {RoomID: 1, Name: "idle", Action: "archived", Reason: "room override", IdleDays: 20, At: start},
+		2: {RoomID: 2, Name: "close", Action: "warned", Reason: "default threshold", IdleDays: 8, At: start},
+	}
+	if fmt.Sprint(entries) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("Entries weren't recorded. Expected=%+v Actual=%+v", expected, entries))
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"bitbucket.org/rbergman/go-hipchat-connect/store"
+	machinery "github.com/RichardKnop/machinery/v1"
+	"github.com/RichardKnop/machinery/v1/backends"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// resultTimeout is how long a task can take, after which it's given up on
+	resultTimeout  = 24 * time.Hour
+	pendingJobsKey = "pending-jobs"
+	// completedJobsPerTick is how many of the tasks enqueued by the scheduler are checked on every tick
+	completedJobsPerTick = 100
+)
+
+// JobSummary is what a job did to the rooms of a tenant. It's the result of the autoArchive task, encoded as JSON.
+type JobSummary struct {
+	JobID     string
+	TenantID  string
+	Processed int
+	Archived  int
+	Warned    int
+	Errors    int
+	// Duration is how many seconds the job took
+	Duration float64
+	DryRun   bool
+	// Interrupted is true if the job was stopped before processing all the rooms, and requeued
+	Interrupted bool `json:",omitempty"`
+	// Error is why the job couldn't process the rooms, if it couldn't
+	Error string `json:",omitempty"`
+	// WouldArchive are the rooms that a dry run would have archived
+	WouldArchive []RoomSummary `json:",omitempty"`
+}
+
+// RoomSummary is a room that a job did something to
+type RoomSummary struct {
+	RoomID   int
+	Name     string
+	IdleDays int
+	// AfterWarning is true if the room would have been warned before archiving it
+	AfterWarning bool `json:",omitempty"`
+}
+
+func (s *JobSummary) encode() (string, error) {
+	value, err := json.Marshal(s)
+	return string(value), err
+}
+
+func decodeJobSummary(value string) (*JobSummary, error) {
+	summary := &JobSummary{}
+	err := json.Unmarshal([]byte(value), summary)
+	return summary, err
+}
+
+// newJobSummary returns the summary of the job from its checkpoint, which holds the counters of the rooms it processed
+func newJobSummary(job *Job, checkpoint *Checkpoint, duration time.Duration) *JobSummary {
+	return &JobSummary{
+		JobID:     job.JobID,
+		TenantID:  job.TenantID,
+		Processed: checkpoint.Processed,
+		Archived:  checkpoint.Archived,
+		Warned:    checkpoint.Warned,
+		Errors:    checkpoint.Errors,
+		Duration:  duration.Seconds(),
+		DryRun:    job.DryRun,
+
+		WouldArchive: job.wouldArchive,
+	}
+}
+
+// logJobSummary logs the summary of a job once it's finished
+func (server *Server) logJobSummary(summary *JobSummary) {
+	log := server.Log.Record("jid", summary.JobID).Record("tid", summary.TenantID)
+	switch {
+	case summary.Error != "":
+		log.Errorf("Job completed with an error after %.2f seconds: %s", summary.Duration, summary.Error)
+	case summary.Interrupted:
+		log.Infof("Job interrupted after %.2f seconds and %d rooms processed, requeued", summary.Duration, summary.Processed)
+	default:
+		log.Infof("Job completed in %.2f seconds: %d rooms processed, %d archived, %d warned, %d errors, dry run: %t",
+			summary.Duration, summary.Processed, summary.Archived, summary.Warned, summary.Errors, summary.DryRun)
+	}
+}
+
+// pendingJob is an autoArchive task enqueued by the scheduler, whose job wasn't seen completed yet
+type pendingJob struct {
+	TaskUUID   string
+	TenantID   string
+	EnqueuedAt time.Time
+
+	// member is the entry of the job in the set of pending jobs
+	member string
+}
+
+// PendingJobs is a Redis set with the tasks enqueued by the scheduler, so it can log the summaries of their jobs once
+// they complete without waiting on every task
+type PendingJobs struct {
+	server *Server
+}
+
+func (s *Server) NewPendingJobs() *PendingJobs {
+	return &PendingJobs{server: s}
+}
+
+// Add remembers the task
+func (p *PendingJobs) Add(job pendingJob) error {
+	value, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	return p.do("SADD", string(value))
+}
+
+// Remove forgets the task, once the summary of its job was logged
+func (p *PendingJobs) Remove(job pendingJob) error {
+	return p.do("SREM", job.member)
+}
+
+// Sample returns up to count random tasks
+func (p *PendingJobs) Sample(count int) ([]pendingJob, error) {
+	conn := p.server.RedisPool.Get()
+	defer conn.Close()
+
+	members, err := redis.Strings(conn.Do("SRANDMEMBER", store.NewDefaultRedisStore(conn).Key(pendingJobsKey), count))
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []pendingJob
+	for _, member := range members {
+		job := pendingJob{member: member}
+		if err := json.Unmarshal([]byte(member), &job); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+func (p *PendingJobs) do(command string, member string) error {
+	conn := p.server.RedisPool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do(command, store.NewDefaultRedisStore(conn).Key(pendingJobsKey), member)
+	return err
+}
+
+// logCompletedJobs logs the summaries of the jobs enqueued by the scheduler that completed. Every call checks at most
+// completedJobsPerTick random tasks, so it takes the same time however many tasks are in flight. Tasks that don't
+// complete within resultTimeout are given up on.
+func (server *Server) logCompletedJobs(taskServer *machinery.Server, now time.Time) {
+	pendingJobs := server.NewPendingJobs()
+	jobs, err := pendingJobs.Sample(completedJobsPerTick)
+	if err != nil {
+		server.Log.Errorf("Couldn't get the pending jobs: %s", err)
+		return
+	}
+
+	for _, job := range jobs {
+		var summary *JobSummary
+		state, err := taskServer.GetBackend().GetState(job.TaskUUID)
+		if err == nil {
+			summary, err = jobSummaryFromState(state)
+			if err != nil {
+				server.Log.Errorf("Task %s for tid-%s failed: %s", job.TaskUUID, job.TenantID, err)
+				pendingJobs.Remove(job)
+				continue
+			}
+		}
+
+		if summary != nil {
+			server.logJobSummary(summary)
+			pendingJobs.Remove(job)
+		} else if now.Sub(job.EnqueuedAt) > resultTimeout {
+			server.Log.Errorf("Task %s for tid-%s didn't complete after %s", job.TaskUUID, job.TenantID, resultTimeout)
+			pendingJobs.Remove(job)
+		}
+	}
+}
+
+// GetJobSummary returns the summary of the job run by the autoArchive task with the given UUID. It returns nil if the
+// task hasn't completed yet.
+func GetJobSummary(taskServer *machinery.Server, taskUUID string) (*JobSummary, error) {
+	state, err := taskServer.GetBackend().GetState(taskUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	return jobSummaryFromState(state)
+}
+
+func jobSummaryFromState(state *backends.TaskState) (*JobSummary, error) {
+	if state.IsFailure() {
+		return nil, fmt.Errorf("Task %s failed: %s", state.TaskUUID, state.Error)
+	}
+
+	if !state.IsSuccess() {
+		return nil, nil
+	}
+
+	if state.Result == nil {
+		return nil, fmt.Errorf("Task %s has no result", state.TaskUUID)
+	}
+
+	value, ok := state.Result.Value.(string)
+	if !ok {
+		return nil, fmt.Errorf("Task %s has a result of type %s, not a job summary", state.TaskUUID, state.Result.Type)
+	}
+
+	return decodeJobSummary(value)
+}
+
+// PrintJobSummary logs the summary of the job run by the autoArchive task with the given UUID
+func PrintJobSummary(taskUUID string) {
+	b := NewBackendServer("hiparchiver.result")
+
+	summary, err := GetJobSummary(NewTaskServer(), taskUUID)
+	if err != nil {
+		b.Log.Errorf("Couldn't get the result of task %s: %s", taskUUID, err)
+		return
+	} else if summary == nil {
+		b.Log.Infof("Task %s hasn't completed yet", taskUUID)
+		return
+	}
+
+	value, _ := summary.encode()
+	b.Log.Infof("Task %s completed: %s", taskUUID, value)
+}
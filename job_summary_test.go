@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"bitbucket.org/rbergman/go-hipchat-connect/tenant"
+	machinery "github.com/RichardKnop/machinery/v1"
+	"github.com/RichardKnop/machinery/v1/backends"
+	"github.com/RichardKnop/machinery/v1/config"
+	"github.com/chakrit/go-bunyan"
+	"github.com/tbruyelle/hipchat-go/hipchat"
+)
+
+func TestJobSummary(t *testing.T) {
+	start := time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC)
+	clock := &testClock{start}
+	hipChat := newFakeHipChat(clock)
+	defer hipChat.server.Close()
+
+	for id := 1; id <= 6; id++ {
+		hipChat.addRoom(hipchat.Room{ID: id, Name: "room"}, hipchat.RoomStatistics{})
+		hipChat.setLastActive(id, start.AddDate(0, 0, -id))
+	}
+
+	log := bunyan.NewStdLogger("test", bunyan.NilSink())
+	worker := Worker{Log: log}
+	installedTenant := &tenant.Tenant{ID: "tenant", Links: tenant.Links{API: hipChat.server.URL}}
+	configuration := &TenantConfiguration{Threshold: 4, WarningDays: 2}
+
+	job := newTestJob(clock, hipChat)
+	job.HTTPClient = newRateLimitedClient(context.Background(), http.DefaultClient, newTokenBucket(clock, func(context.Context, time.Duration) error { return nil }, 0, 1), log)
+
+	checkpoint := newCheckpoint("jobId", start)
+	worker.autoArchiveRooms(context.Background(), job, configuration, nil, 1000, time.Now(), installedTenant, checkpoint)
+
+	value, err := newJobSummary(job, checkpoint, 3*time.Second).encode()
+	if err != nil {
+		t.Fatal(fmt.Sprintf("Summary wasn't encoded. Error=%v", err))
+	}
+
+	summary, err := jobSummaryFromState(&backends.TaskState{
+		TaskUUID: "taskId",
+		State:    backends.SuccessState,
+		Result:   &backends.TaskResult{Type: "string", Value: value},
+	})
+	if err != nil || summary == nil {
+		t.Fatal(fmt.Sprintf("Summary wasn't decoded. Error=%v", err))
+	}
+
+	expected := JobSummary{JobID: job.JobID, TenantID: job.TenantID, Processed: 6, Warned: 5, Duration: 3, DryRun: job.DryRun}
+	if fmt.Sprintf("%+v", *summary) != fmt.Sprintf("%+v", expected) {
+		t.Error(fmt.Sprintf("Summary doesn't match the job. Expected=%+v Actual=%+v", expected, *summary))
+	}
+
+	if pending, err := jobSummaryFromState(&backends.TaskState{TaskUUID: "taskId", State: backends.StartedState}); pending != nil || err != nil {
+		t.Error(fmt.Sprintf("Summary of a running task was returned. Actual=%+v Error=%v", pending, err))
+	}
+
+	if _, err := jobSummaryFromState(&backends.TaskState{TaskUUID: "taskId", State: backends.FailureState, Error: "boom"}); err == nil {
+		t.Error("Failure of the task wasn't returned")
+	}
+}
+
+func TestPreviewRecordsRooms(t *testing.T) {
+	start := time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC)
+	clock := &testClock{start}
+	hipChat := newFakeHipChat(clock)
+	defer hipChat.server.Close()
+
+	for id := 1; id <= 6; id++ {
+		hipChat.addRoom(hipchat.Room{ID: id, Name: fmt.Sprintf("room-%d", id)}, hipchat.RoomStatistics{})
+		hipChat.setLastActive(id, start.AddDate(0, 0, -id))
+	}
+
+	job := newTestJob(clock, hipChat)
+	job.DryRun = true
+	configuration := &TenantConfiguration{Threshold: 5}
+
+	rooms, _ := job.GetRooms()
+	job.processRooms(rooms, configuration, nil)
+	summary := newJobSummary(job, newCheckpoint(job.JobID, start), time.Second)
+
+	archived := map[int]RoomSummary{}
+	for _, room := range summary.WouldArchive {
+		archived[room.RoomID] = room
+	}
+
+	if len(archived) != 2 || archived[5] != (RoomSummary{5, "room-5", 5, false}) || archived[6] != (RoomSummary{6, "room-6", 6, false}) {
+		t.Error(fmt.Sprintf("Preview didn't record the rooms. Expected=rooms 5 and 6 Actual=%+v", summary.WouldArchive))
+	}
+
+	for id, room := range hipChat.rooms {
+		if room.IsArchived {
+			t.Error(fmt.Sprintf("Preview archived a room. Room=%d", id))
+		}
+	}
+}
+
+func TestSchedulerLogsCompletedJobs(t *testing.T) {
+	r := newFakeRedis(&testClock{time.Now()})
+	s := newFakeRedisServer(r)
+
+	var messages []string
+	s.Log = bunyan.NewStdLogger("test", bunyan.SinkFunc(func(record bunyan.Record) error {
+		messages = append(messages, fmt.Sprint(record["msg"]))
+		return nil
+	}))
+
+	// the eager task server runs the tasks as soon as they are enqueued
+	taskServer, err := machinery.NewServer(&config.Config{Broker: "eager", ResultBackend: "eager", DefaultQueue: "machinery_tasks"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	taskServer.RegisterTask(autoArchiveTask, func(tenantID string) (string, error) {
+		return (&JobSummary{JobID: "job", TenantID: tenantID, Processed: 3, Archived: 1}).encode()
+	})
+
+	election := s.NewLeaderElection(time.Hour)
+	defer election.Resign()
+	if !election.IsLeader() {
+		t.Fatal("The scheduler didn't become the leader")
+	}
+
+	s.NewTenantIndex().Add("tenant-1")
+	s.scheduleTasks(election, taskServer, 0, nil)
+
+	completed := "Job completed in 0.00 seconds: 3 rooms processed, 1 archived, 0 warned, 0 errors, dry run: false"
+	if !strings.Contains(strings.Join(messages, "\n"), completed) || len(r.sets["hipchat:pending-jobs"]) != 0 {
+		t.Errorf("The summary of the job wasn't logged. Expected=%s Actual=%v", completed, messages)
+	}
+
+	now := time.Now()
+	s.NewPendingJobs().Add(pendingJob{TaskUUID: "task_running", TenantID: "tenant-1", EnqueuedAt: now.Add(-time.Hour)})
+	s.NewPendingJobs().Add(pendingJob{TaskUUID: "task_lost", TenantID: "tenant-2", EnqueuedAt: now.Add(-resultTimeout - time.Hour)})
+	s.logCompletedJobs(taskServer, now)
+
+	jobs, _ := s.NewPendingJobs().Sample(completedJobsPerTick)
+	if len(jobs) != 1 || jobs[0].TaskUUID != "task_running" {
+		t.Errorf("The wrong tasks were given up on. Expected=[task_running] Actual=%+v", jobs)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	leadersStoreKey = "leaders"
+	schedulerLeader = "scheduler"
+	// leaderCheckInterval is how many tenants the leader dispatches between checks of its leadership
+	leaderCheckInterval = 50
+)
+
+// LeaderElection makes sure only one of the scheduler processes dispatches the tenants. The leader is the holder of a
+// lease, which it renews for as long as it runs. The others keep trying to take the lease, so one of them takes over
+// when the leader stops renewing it.
+type LeaderElection struct {
+	server *Server
+	ttl    time.Duration
+
+	mutex     sync.Mutex
+	lease     *Lease
+	following bool
+}
+
+func (s *Server) NewLeaderElection(ttl time.Duration) *LeaderElection {
+	return &LeaderElection{server: s, ttl: ttl}
+}
+
+// Run tries to become the leader every third of the ttl, until stop is closed. It gives up the leadership when it
+// returns.
+func (e *LeaderElection) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+
+	e.campaign()
+	for {
+		select {
+		case <-stop:
+			e.Resign()
+			return
+		case <-ticker.C:
+			e.campaign()
+		}
+	}
+}
+
+// IsLeader returns true if this process is the leader. It asks Redis, so it's meant to be called right before
+// dispatching the tenants.
+func (e *LeaderElection) IsLeader() bool {
+	e.campaign()
+
+	e.mutex.Lock()
+	lease := e.lease
+	e.mutex.Unlock()
+
+	return lease != nil && lease.Check()
+}
+
+// Resign gives up the leadership, so another process can take over without waiting for the lease to expire
+func (e *LeaderElection) Resign() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.lease == nil {
+		return
+	}
+
+	if err := e.lease.Release(); err != nil {
+		e.server.Log.Errorf("Couldn't give up the leadership: %s", err)
+	} else {
+		e.server.Log.Infof("Gave up the leadership with fence %d", e.lease.Fence)
+	}
+
+	e.lease = nil
+}
+
+// campaign takes the lease if nobody holds it, and notices when ours was lost
+func (e *LeaderElection) campaign() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.lease != nil {
+		if !e.lease.Lost() {
+			return
+		}
+
+		e.server.Log.Errorf("Lost the leadership with fence %d", e.lease.Fence)
+		e.lease.Release()
+		e.lease = nil
+	}
+
+	lease, err := e.server.AcquireLease(leadersStoreKey, schedulerLeader, e.ttl)
+	if err != nil {
+		e.server.Log.Errorf("Couldn't take the leadership: %s", err)
+		return
+	} else if lease == nil {
+		if !e.following {
+			e.server.Log.Infof("Another scheduler is the leader, waiting for it to go away")
+			e.following = true
+		}
+		return
+	}
+
+	e.server.Log.Infof("Became the leader with fence %d", lease.Fence)
+	e.lease = lease
+	e.following = false
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLeaderElection(t *testing.T) {
+	r := newFakeRedis(&testClock{time.Now()})
+	s := newFakeRedisServer(r)
+
+	first := s.NewLeaderElection(time.Hour)
+	second := s.NewLeaderElection(time.Hour)
+	defer first.Resign()
+	defer second.Resign()
+
+	if !first.IsLeader() {
+		t.Fatal("The first scheduler didn't become the leader")
+	}
+
+	if second.IsLeader() {
+		t.Error("Two schedulers are the leader")
+	}
+
+	first.Resign()
+	if !second.IsLeader() {
+		t.Error("The leadership wasn't handed over after the leader resigned")
+	}
+
+	if first.IsLeader() {
+		t.Error("The scheduler that resigned is the leader again")
+	}
+}
+
+func TestLeaderTakeover(t *testing.T) {
+	r := newFakeRedis(&testClock{time.Now()})
+	s := newFakeRedisServer(r)
+
+	first := s.NewLeaderElection(time.Hour)
+	second := s.NewLeaderElection(time.Hour)
+	defer first.Resign()
+	defer second.Resign()
+
+	first.IsLeader()
+
+	// the first scheduler stops renewing its lease, like when its process hangs
+	r.advance(2 * time.Hour)
+
+	if !second.IsLeader() {
+		t.Fatal("The leadership wasn't taken over once the lease expired")
+	}
+
+	if first.IsLeader() {
+		t.Error("The former leader still thinks it's the leader")
+	}
+
+	if second.lease.Fence <= 1 {
+		t.Errorf("The new leader didn't get a higher fence. Actual=%d", second.lease.Fence)
+	}
+}
+
+func TestDeposedLeaderStopsDispatching(t *testing.T) {
+	r := newFakeRedis(&testClock{time.Now()})
+	s := newFakeRedisServer(r)
+
+	index := s.NewTenantIndex()
+	for i := 0; i < leaderCheckInterval*3; i++ {
+		index.Add(fmt.Sprintf("tenant-%03d", i))
+	}
+
+	leader := s.NewLeaderElection(time.Hour)
+	other := s.NewLeaderElection(time.Hour)
+	defer leader.Resign()
+	defer other.Resign()
+
+	if !leader.IsLeader() {
+		t.Fatal("The scheduler didn't become the leader")
+	}
+
+	var enqueued []string
+	s.dispatchTenants(leader, 0, nil, time.Now(), func(tenantID string) error {
+		enqueued = append(enqueued, tenantID)
+		if len(enqueued) == 10 {
+			// another scheduler takes over while the leader is dispatching
+			r.advance(2 * time.Hour)
+			other.IsLeader()
+		}
+		return nil
+	})
+
+	if len(enqueued) != leaderCheckInterval-1 {
+		t.Errorf("The deposed leader kept dispatching. Expected=%d tenants Actual=%d", leaderCheckInterval-1, len(enqueued))
+	}
+
+	if lastRun, _ := s.NewLastRuns().Get(enqueued[0]); lastRun.IsZero() {
+		t.Error("The last run of a dispatched tenant wasn't recorded")
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"bitbucket.org/rbergman/go-hipchat-connect/store"
+	"github.com/garyburd/redigo/redis"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	locksStoreKey  = "locks"
+	fencesStoreKey = "fences"
+)
+
+// errStaleFence is returned by the writes of a lease holder that someone else took the lease from
+var errStaleFence = errors.New("The lease was taken by someone else")
+
+// acquireScript takes the lease if it's free, and returns its fence. The fence is only incremented when the lease is
+// taken, so the fences key always has the fence of the current holder.
+var acquireScript = redis.NewScript(2, `
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return redis.call("INCR", KEYS[2])
+end
+return 0`)
+
+// renewScript extends the lease only if it's still ours
+var renewScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// releaseScript deletes the lease only if it's still ours
+var releaseScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// fencedSetScript writes the value, with an expiration in seconds unless it's 0, only if the fence is still the one of
+// the current holder of the lease
+var fencedSetScript = redis.NewScript(2, `
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+if ARGV[3] == "0" then
+	redis.call("SET", KEYS[2], ARGV[2])
+else
+	redis.call("SET", KEYS[2], ARGV[2], "EX", ARGV[3])
+end
+return 1`)
+
+// fencedDelScript deletes the key only if the fence is still the one of the current holder of the lease
+var fencedDelScript = redis.NewScript(2, `
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call("DEL", KEYS[2])
+return 1`)
+
+// fencedAddScript adds the members to the set and sets it to expire in ARGV[2] seconds, only if the fence is still the
+// one of the current holder of the lease
+var fencedAddScript = redis.NewScript(2, `
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call("SADD", KEYS[2], unpack(ARGV, 3))
+redis.call("EXPIRE", KEYS[2], ARGV[2])
+return 1`)
+
+// Lease is a Redis lock that expires unless it's renewed. Every lease of a key gets a fence that is higher than the
+// fences of all its previous leases. Writes made through FencedStore are rejected once someone else took the lease, so
+// a holder whose lease expired can't overwrite what the new holder wrote.
+type Lease struct {
+	pool      *redis.Pool
+	key       string
+	fencesKey string
+	token     string
+	ttl       time.Duration
+	Fence     int64
+
+	mutex sync.Mutex
+	lost  bool
+	done  chan struct{}
+}
+
+// AcquireLease tries to take the lease of the key in the given scope. It returns nil if someone else holds it. The
+// lease is renewed in the background until it's released.
+func (s *Server) AcquireLease(scope string, key string, ttl time.Duration) (*Lease, error) {
+	conn := s.RedisPool.Get()
+	defer conn.Close()
+
+	redisStore := store.NewDefaultRedisStore(conn)
+	lease := &Lease{
+		pool:      s.RedisPool,
+		key:       redisStore.Sub(scope).Key(key),
+		fencesKey: redisStore.Sub(fencesStoreKey).Key(scope + ":" + key),
+		token:     uuid.NewV4().String(),
+		ttl:       ttl,
+		done:      make(chan struct{}),
+	}
+
+	fence, err := redis.Int64(acquireScript.Do(conn, lease.key, lease.fencesKey, lease.token, int64(ttl/time.Millisecond)))
+	if err != nil {
+		return nil, err
+	} else if fence == 0 {
+		return nil, nil
+	}
+	lease.Fence = fence
+
+	go lease.keepAlive()
+	return lease, nil
+}
+
+// AcquireTenantLock takes the lock that makes sure only one worker processes the rooms of the tenant at a time
+func (s *Server) AcquireTenantLock(tenantID string, ttl time.Duration) (*Lease, error) {
+	return s.AcquireLease(locksStoreKey, tenantID, ttl)
+}
+
+// Lost returns true if the lease couldn't be renewed, so someone else may hold it now
+func (l *Lease) Lost() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.lost
+}
+
+// Check asks Redis if the lease is still ours. It's meant to be called right before doing something that only the
+// holder of the lease should do.
+func (l *Lease) Check() bool {
+	if l.Lost() {
+		return false
+	}
+
+	conn := l.pool.Get()
+	defer conn.Close()
+
+	token, err := redis.String(conn.Do("GET", l.key))
+	if err != nil || token != l.token {
+		l.setLost()
+		return false
+	}
+
+	return true
+}
+
+// Release stops renewing the lease, and frees it if it's still ours
+func (l *Lease) Release() error {
+	close(l.done)
+
+	conn := l.pool.Get()
+	defer conn.Close()
+
+	_, err := releaseScript.Do(conn, l.key, l.token)
+	return err
+}
+
+// FencedStore returns a store, in the scope of the tenant stores, whose writes are rejected with errStaleFence once
+// someone else took the lease. The lease is then lost.
+func (s *Server) FencedStore(scope string, lease *Lease) roomSetStore {
+	return &fencedStore{pool: s.RedisPool, scope: store.NewDefaultRedisStore(nil).Key(scope), lease: lease}
+}
+
+func (l *Lease) keepAlive() {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	lastRenewed := time.Now()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			renewed, err := l.renew()
+			if err == nil && renewed {
+				lastRenewed = time.Now()
+				continue
+			}
+
+			// Errors talking to Redis are retried for as long as the lease may still be ours
+			if err == nil || time.Since(lastRenewed) >= l.ttl {
+				l.setLost()
+				return
+			}
+		}
+	}
+}
+
+func (l *Lease) renew() (bool, error) {
+	conn := l.pool.Get()
+	defer conn.Close()
+
+	renewed, err := redis.Int(renewScript.Do(conn, l.key, l.token, int64(l.ttl/time.Millisecond)))
+	return renewed == 1, err
+}
+
+func (l *Lease) setLost() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.lost = true
+}
+
+// fencedStore is a Redis store whose writes are made only while the fence of the lease is the current one. It takes a
+// connection from the pool for every operation, so it doesn't hold one for the whole job and can be shared by the
+// goroutines processing the rooms.
+type fencedStore struct {
+	pool  *redis.Pool
+	scope string
+	lease *Lease
+}
+
+func (s *fencedStore) Key(k string) string {
+	return s.scope + ":" + k
+}
+
+func (s *fencedStore) Get(k string) ([]byte, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	return store.NewRedisStore(conn, s.scope).Get(k)
+}
+
+func (s *fencedStore) Del(k string) error {
+	return s.fenced(s.do(fencedDelScript, s.lease.fencesKey, s.Key(k), s.lease.Fence))
+}
+
+func (s *fencedStore) Set(k string, v []byte) error {
+	if v == nil {
+		return s.Del(k)
+	}
+	return s.fenced(s.do(fencedSetScript, s.lease.fencesKey, s.Key(k), s.lease.Fence, v, 0))
+}
+
+func (s *fencedStore) SetEx(k string, v []byte, sec int) error {
+	if v == nil || sec <= 0 {
+		return s.Del(k)
+	}
+	return s.fenced(s.do(fencedSetScript, s.lease.fencesKey, s.Key(k), s.lease.Fence, v, sec))
+}
+
+func (s *fencedStore) AddRooms(k string, roomIDs []int, sec int) error {
+	args := []interface{}{s.lease.fencesKey, s.Key(k), s.lease.Fence, sec}
+	for _, roomID := range roomIDs {
+		args = append(args, roomID)
+	}
+	return s.fenced(s.do(fencedAddScript, args...))
+}
+
+func (s *fencedStore) Rooms(k string) ([]int, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	return redis.Ints(conn.Do("SMEMBERS", s.Key(k)))
+}
+
+func (s *fencedStore) Sub(scope string) store.Store {
+	return &fencedStore{pool: s.pool, scope: s.Key(scope), lease: s.lease}
+}
+
+func (s *fencedStore) do(script *redis.Script, keysAndArgs ...interface{}) (interface{}, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	return script.Do(conn, keysAndArgs...)
+}
+
+// fenced turns the result of a fenced script into an error, and loses the lease if the fence was stale
+func (s *fencedStore) fenced(result interface{}, err error) error {
+	written, err := redis.Int(result, err)
+	if err != nil {
+		return err
+	} else if written == 0 {
+		s.lease.setLost()
+		return errStaleFence
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAcquireLease(t *testing.T) {
+	r := newFakeRedis(&testClock{time.Now()})
+	s := newFakeRedisServer(r)
+
+	lease, err := s.AcquireTenantLock("tenant-1", time.Hour)
+	if err != nil || lease == nil {
+		t.Fatalf("AcquireTenantLock didn't take a free lock. Actual=%v %v", lease, err)
+	}
+	defer lease.Release()
+
+	if lease.Fence != 1 || !lease.Check() || lease.Lost() {
+		t.Errorf("The lease was wrong. Expected fence=1 held Actual fence=%d held %v lost %v", lease.Fence, lease.Check(), lease.Lost())
+	}
+
+	other, err := s.AcquireTenantLock("tenant-2", time.Hour)
+	if err != nil || other == nil || other.Fence != 1 {
+		t.Errorf("The leases of different tenants conflicted. Actual=%v %v", other, err)
+	} else {
+		other.Release()
+	}
+}
+
+func TestAcquireLeaseConflict(t *testing.T) {
+	r := newFakeRedis(&testClock{time.Now()})
+	s := newFakeRedisServer(r)
+
+	lease, _ := s.AcquireTenantLock("tenant-1", time.Hour)
+
+	for i := 0; i < 3; i++ {
+		other, err := s.AcquireTenantLock("tenant-1", time.Hour)
+		if err != nil || other != nil {
+			t.Fatalf("AcquireTenantLock took a held lock. Actual=%v %v", other, err)
+		}
+	}
+
+	// the failed attempts don't move the fence, so the holder can still write
+	if err := s.FencedStore(checkpointsStoreKey, lease).Set("tenant-1", []byte("{}")); err != nil {
+		t.Errorf("The holder couldn't write after failed attempts to take its lock: %v", err)
+	}
+
+	if err := lease.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	next, err := s.AcquireTenantLock("tenant-1", time.Hour)
+	if err != nil || next == nil || next.Fence != 2 {
+		t.Fatalf("AcquireTenantLock didn't take a released lock with the next fence. Actual=%v %v", next, err)
+	}
+	next.Release()
+}
+
+func TestRenewLease(t *testing.T) {
+	r := newFakeRedis(&testClock{time.Now()})
+	s := newFakeRedisServer(r)
+
+	lease, _ := s.AcquireTenantLock("tenant-1", time.Hour)
+	defer lease.Release()
+
+	r.advance(45 * time.Minute)
+	if renewed, err := lease.renew(); err != nil || !renewed {
+		t.Fatalf("The lease wasn't renewed. Actual=%v %v", renewed, err)
+	}
+
+	r.advance(45 * time.Minute)
+	if !lease.Check() {
+		t.Error("The renewed lease expired")
+	}
+
+	if other, _ := s.AcquireTenantLock("tenant-1", time.Hour); other != nil {
+		t.Error("AcquireTenantLock took a renewed lock")
+	}
+}
+
+func TestLostLease(t *testing.T) {
+	r := newFakeRedis(&testClock{time.Now()})
+	s := newFakeRedisServer(r)
+
+	lease, _ := s.AcquireTenantLock("tenant-1", time.Hour)
+	defer lease.Release()
+	states := newRoomStates(s.FencedStore(roomStatesStoreKey, lease).Sub("tenant-1"))
+	if err := states.Set(1, &RoomState{ArchivedLastActive: "2016-06-01"}); err != nil {
+		t.Fatal(err)
+	}
+
+	r.advance(2 * time.Hour)
+
+	next, _ := s.AcquireTenantLock("tenant-1", time.Hour)
+	if next == nil {
+		t.Fatal("AcquireTenantLock didn't take an expired lock")
+	}
+	defer next.Release()
+
+	if renewed, _ := lease.renew(); renewed {
+		t.Error("The expired lease was renewed")
+	}
+
+	if lease.Check() || !lease.Lost() {
+		t.Error("The expired lease wasn't lost")
+	}
+
+	// the writes of the former holder are rejected, and don't overwrite the ones of the new holder
+	nextStates := newRoomStates(s.FencedStore(roomStatesStoreKey, next).Sub("tenant-1"))
+	if err := nextStates.Set(1, &RoomState{ArchivedLastActive: "2016-06-02"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := states.Set(1, &RoomState{ArchivedLastActive: "2016-06-03"}); err != errStaleFence {
+		t.Errorf("The former holder could write. Expected=%v Actual=%v", errStaleFence, err)
+	}
+
+	if err := states.Del(1); err != errStaleFence {
+		t.Errorf("The former holder could delete. Expected=%v Actual=%v", errStaleFence, err)
+	}
+
+	if state, _ := nextStates.Get(1); state.ArchivedLastActive != "2016-06-02" {
+		t.Errorf("The state was overwritten. Expected=2016-06-02 Actual=%s", state.ArchivedLastActive)
+	}
+}
+
+func TestFencedStoreReturnsConnections(t *testing.T) {
+	s := newFakeRedisServer(newFakeRedis(&testClock{time.Now()}))
+	// without idle connections, the active ones are the ones that weren't closed
+	s.RedisPool.MaxIdle = 0
+
+	lease, _ := s.AcquireTenantLock("tenant-1", time.Hour)
+	defer lease.Release()
+
+	fenced := s.FencedStore(checkpointsStoreKey, lease)
+	if err := fenced.Set("tenant-1", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fenced.AddRooms("tenant-1:processed", []int{1, 2}, 60); err != nil {
+		t.Fatal(err)
+	}
+	fenced.Get("tenant-1")
+	fenced.Rooms("tenant-1:processed")
+	fenced.Sub("tenant-1").Get("1")
+
+	if active := s.RedisPool.ActiveCount(); active != 0 {
+		t.Errorf("The fenced store kept connections. Expected=0 Actual=%d", active)
+	}
+}
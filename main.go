@@ -18,12 +18,13 @@ func NewBackendServer(appName string) *Server {
 		RedisPool: newRedisPool(),
 	}
 
-	s := &Server{*ws}
+	s := &Server{Server: *ws}
 	return s
 }
 
 func main() {
-	var role = flag.String("role", "web", "Which role to start: web|scheduler|worker")
+	var role = flag.String("role", "web", "Which role to start: web|scheduler|worker|backfill|result")
+	var taskUUID = flag.String("task", "", "The UUID of the task whose result is printed by the result role")
 	flag.Parse()
 
 	switch *role {
@@ -40,14 +41,24 @@ func main() {
 
 	case "worker":
 		StartWorker()
+
+	case "backfill":
+		BackfillTenantIndex()
+
+	case "result":
+		PrintJobSummary(*taskUUID)
 	}
 }
 
 func startWeb() {
-	s := &Server{*web.NewServer("./static/descriptor.json", "public")}
-	s.MountCommon()
+	s := &Server{Server: *web.NewServer("./static/descriptor.json", "public"), TaskServer: NewTaskServer()}
+	s.MountDescriptor()
+	s.MountHealthCheck()
 	s.MountInstallable("/installable")
 	s.MountConfigurable(s.configurable, s.postConfigurable)
+	s.MountHistory("/history")
+	s.MountRestore("/restore")
+	s.MountConfigurationAPI("/api/v1/configuration")
 	s.Start()
 }
 
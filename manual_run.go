@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"bitbucket.org/rbergman/go-hipchat-connect/store"
+	"bitbucket.org/rbergman/go-hipchat-connect/util"
+	machinery "github.com/RichardKnop/machinery/v1"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	manualRunsStoreKey = "manual-runs"
+	previewsStoreKey   = "previews"
+)
+
+// startPreview enqueues a dry run for the tenant, and remembers its task so the page can show its result
+func (s *Server) startPreview(taskServer *machinery.Server, tenantID string) (int, error) {
+	status, err := s.allowManualRun(tenantID, "preview")
+	if err != nil {
+		return status, err
+	}
+
+	result, err := s.sendTask(taskServer, previewAutoArchiveTask, tenantID)
+	if err != nil {
+		s.releaseManualRun(tenantID, "preview")
+		return http.StatusInternalServerError, fmt.Errorf("Couldn't start the preview")
+	}
+
+	err = s.NewTenantStore(previewsStoreKey).SetEx(tenantID, []byte(result.Signature.UUID), taskResultsTTL())
+	if err != nil {
+		s.Log.Errorf("Couldn't save the preview task of tid-%s: %s", tenantID, err)
+		return http.StatusInternalServerError, fmt.Errorf("Internal Server Error")
+	}
+
+	return http.StatusOK, nil
+}
+
+// runNow enqueues a run for the tenant, outside of its schedule
+func (s *Server) runNow(taskServer *machinery.Server, tenantID string) (int, error) {
+	status, err := s.allowManualRun(tenantID, "run")
+	if err != nil {
+		return status, err
+	}
+
+	_, err = s.scheduleTask(taskServer, tenantID)
+	if err != nil {
+		s.releaseManualRun(tenantID, "run")
+		return http.StatusInternalServerError, fmt.Errorf("Couldn't start the run")
+	}
+
+	return http.StatusOK, nil
+}
+
+// lastPreview returns the summary of the last preview of the tenant, or nil if there isn't one. It returns true if
+// the preview is still running.
+func (s *Server) lastPreview(taskServer *machinery.Server, tenantID string) (*JobSummary, bool) {
+	taskUUID, err := s.NewTenantStore(previewsStoreKey).Get(tenantID)
+	if err != nil {
+		s.Log.Errorf("Couldn't get the preview task of tid-%s: %s", tenantID, err)
+		return nil, false
+	} else if len(taskUUID) == 0 {
+		return nil, false
+	}
+
+	summary, err := GetJobSummary(taskServer, string(taskUUID))
+	if err != nil {
+		s.Log.Errorf("Couldn't get the preview of tid-%s: %s", tenantID, err)
+		return &JobSummary{TenantID: tenantID, Error: "The preview failed"}, false
+	}
+
+	return summary, summary == nil
+}
+
+// allowManualRun lets a tenant start the action once every MANUAL_RUN_INTERVAL seconds, so the task queue can't be
+// flooded from the configuration page
+func (s *Server) allowManualRun(tenantID string, action string) (int, error) {
+	interval := util.Env.GetIntOr("MANUAL_RUN_INTERVAL", 600)
+
+	conn := s.RedisPool.Get()
+	defer conn.Close()
+
+	key := manualRunKey(conn, tenantID, action)
+	_, err := redis.String(conn.Do("SET", key, time.Now().UTC().Format(time.RFC3339), "NX", "EX", interval))
+	if err == redis.ErrNil {
+		wait, _ := redis.Int(conn.Do("TTL", key))
+		return http.StatusTooManyRequests, fmt.Errorf("Please wait %s before starting another %s", time.Duration(wait)*time.Second, action)
+	} else if err != nil {
+		s.Log.Errorf("Couldn't rate limit the %s of tid-%s: %s", action, tenantID, err)
+		return http.StatusInternalServerError, fmt.Errorf("Internal Server Error")
+	}
+
+	return http.StatusOK, nil
+}
+
+// releaseManualRun lets the tenant start the action again right away, when it couldn't be enqueued
+func (s *Server) releaseManualRun(tenantID string, action string) {
+	conn := s.RedisPool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("DEL", manualRunKey(conn, tenantID, action)); err != nil {
+		s.Log.Errorf("Couldn't release the %s of tid-%s: %s", action, tenantID, err)
+	}
+}
+
+// manualRunKey is the key that rate limits the action of the tenant
+func manualRunKey(conn redis.Conn, tenantID string, action string) string {
+	return store.NewDefaultRedisStore(conn).Sub(manualRunsStoreKey).Key(action + ":" + tenantID)
+}
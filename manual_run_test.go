@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestManualRunIsRateLimited(t *testing.T) {
+	s := newFakeRedisServer(newFakeRedis(&testClock{time.Now()}))
+
+	if status, err := s.allowManualRun("tenant", "preview"); err != nil {
+		t.Fatalf("The first preview wasn't allowed. Status=%d Error=%v", status, err)
+	}
+
+	if status, _ := s.allowManualRun("tenant", "preview"); status != http.StatusTooManyRequests {
+		t.Errorf("The second preview wasn't rate limited. Expected=%d Actual=%d", http.StatusTooManyRequests, status)
+	}
+
+	if status, err := s.allowManualRun("tenant", "run"); err != nil {
+		t.Errorf("The run was rate limited by the preview. Status=%d Error=%v", status, err)
+	}
+
+	s.releaseManualRun("tenant", "preview")
+	if status, err := s.allowManualRun("tenant", "preview"); err != nil {
+		t.Errorf("The preview wasn't allowed once released. Status=%d Error=%v", status, err)
+	}
+}
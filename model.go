@@ -1,15 +1,20 @@
 package main
 
 import (
+	"sync"
 	"time"
 
 	"bitbucket.org/rbergman/go-hipchat-connect/web"
+	machinery "github.com/RichardKnop/machinery/v1"
 	"github.com/chakrit/go-bunyan"
 	"github.com/tbruyelle/hipchat-go/hipchat"
 )
 
 type Server struct {
 	web.Server
+	// TaskServer is shared by the requests of the web role that enqueue tasks or read their results, and by the
+	// workers that requeue the jobs they were interrupted on
+	TaskServer *machinery.Server
 }
 
 type Worker struct {
@@ -22,6 +27,17 @@ type Worker struct {
 
 type WorkRequest struct {
 	TenantID string
+	// DryRun forces the job to be a dry run
+	DryRun bool
+	// Result receives the summary of the job once the worker is done with it, if it's not nil
+	Result chan *JobSummary
+}
+
+// done sends the summary of the job to whoever is waiting for it
+func (r WorkRequest) done(summary *JobSummary) {
+	if r.Result != nil {
+		r.Result <- summary
+	}
 }
 
 type Job struct {
@@ -32,6 +48,24 @@ type Job struct {
 	Clock      clock
 	HipChatURL string
 	DryRun     bool
+	States     *RoomStates
+	// Lock is the lock of the tenant held while processing its rooms, if any
+	Lock *Lease
+	// Checkpoints saves the progress of the job, so it can be resumed
+	Checkpoints *Checkpoints
+	// Concurrency is how many rooms are processed at the same time, sharing the rate limit of HTTPClient
+	Concurrency int
+	HTTPClient  *rateLimitedClient
+
+	// listedStatistics are the statistics of the rooms included in the last room list. It's only replaced while no
+	// rooms are being processed.
+	listedStatistics map[int]*hipchat.RoomStatistics
+
+	mutex sync.Mutex
+	// wouldArchive are the rooms that a dry run would have archived
+	wouldArchive []RoomSummary
+	// audit is what the job did to the rooms, for the history of the tenant
+	audit []AuditEntry
 }
 
 // clock is used to be able to mock time.Now() for testing purposes
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/tbruyelle/hipchat-go/hipchat"
+)
+
+// PolicyAction is what the auto archiver does with a room matched by a PolicyRule
+type PolicyAction string
+
+const (
+	// ActionArchive archives the room after it has been idle for PolicyRule.Days
+	ActionArchive PolicyAction = "archive"
+	// ActionNever never archives the room
+	ActionNever PolicyAction = "never"
+	// ActionNotify lets the room know it has been idle for PolicyRule.Days, without archiving it
+	ActionNotify PolicyAction = "notify"
+)
+
+// PolicyRule matches rooms on a set of conditions and decides what to do with them. Only the conditions that
+// are set are evaluated, and all of them need to match for the rule to apply.
+type PolicyRule struct {
+	Name string
+
+	// NameGlob matches the room name using shell patterns, e.g. "oncall-*". Case insensitive.
+	NameGlob string `json:",omitempty"`
+	// NameRegex matches the room name using a regular expression
+	NameRegex string `json:",omitempty"`
+	// Privacy matches "public" or "private" rooms
+	Privacy string `json:",omitempty"`
+	// GuestAccess matches rooms with guest access enabled (true) or disabled (false)
+	GuestAccess *bool `json:",omitempty"`
+	// Topic matches rooms whose topic contains the value. Case insensitive.
+	Topic string `json:",omitempty"`
+	// OwnerID matches rooms owned by the user
+	OwnerID int `json:",omitempty"`
+	// MinAgeDays and MaxAgeDays match rooms created at least / at most that many days ago
+	MinAgeDays int `json:",omitempty"`
+	MaxAgeDays int `json:",omitempty"`
+
+	Action PolicyAction
+	Days   int `json:",omitempty"`
+}
+
+// Policy is an ordered list of rules, the first rule that matches a room decides what happens to it
+type Policy []PolicyRule
+
+// Decision is the result of evaluating the configuration of a tenant against a room
+type Decision struct {
+	Action    PolicyAction
+	Threshold int
+	Reason    string
+}
+
+// Validate returns an error if any of the rules of the policy can't be evaluated
+func (p Policy) Validate() error {
+	for i, rule := range p {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+
+		switch rule.Action {
+		case ActionArchive, ActionNotify:
+			if rule.Days < 1 {
+				return fmt.Errorf("Rule %s: days must be greater than 0", name)
+			}
+		case ActionNever:
+		default:
+			return fmt.Errorf("Rule %s: unknown action '%s'", name, rule.Action)
+		}
+
+		if rule.NameGlob != "" {
+			if _, err := path.Match(rule.NameGlob, ""); err != nil {
+				return fmt.Errorf("Rule %s: invalid name glob: %s", name, err)
+			}
+		}
+
+		if rule.NameRegex != "" {
+			if _, err := regexp.Compile(rule.NameRegex); err != nil {
+				return fmt.Errorf("Rule %s: invalid name regex: %s", name, err)
+			}
+		}
+
+		if rule.Privacy != "" && rule.Privacy != "public" && rule.Privacy != "private" {
+			return fmt.Errorf("Rule %s: privacy must be public or private", name)
+		}
+	}
+
+	return nil
+}
+
+// Match returns the first rule that matches the room, or nil if none does. daysSinceCreated is -1 when unknown,
+// in which case rules with age conditions don't match.
+func (p Policy) Match(room *hipchat.Room, daysSinceCreated int) *PolicyRule {
+	for i := range p {
+		if p[i].matches(room, daysSinceCreated) {
+			return &p[i]
+		}
+	}
+
+	return nil
+}
+
+// needsRoomDetails returns true if any of the rules look at fields that are only returned by the room API, and not
+// by the room list API
+func (p Policy) needsRoomDetails() bool {
+	for _, rule := range p {
+		if rule.GuestAccess != nil || rule.OwnerID != 0 || rule.MinAgeDays != 0 || rule.MaxAgeDays != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *PolicyRule) matches(room *hipchat.Room, daysSinceCreated int) bool {
+	name := strings.ToLower(room.Name)
+
+	if r.NameGlob != "" {
+		if ok, _ := path.Match(strings.ToLower(r.NameGlob), name); !ok {
+			return false
+		}
+	}
+
+	if r.NameRegex != "" {
+		if ok, _ := regexp.MatchString(r.NameRegex, room.Name); !ok {
+			return false
+		}
+	}
+
+	if r.Privacy != "" && r.Privacy != room.Privacy {
+		return false
+	}
+
+	if r.GuestAccess != nil && *r.GuestAccess != isGuestAccessible(room) {
+		return false
+	}
+
+	if r.Topic != "" && !strings.Contains(strings.ToLower(room.Topic), strings.ToLower(r.Topic)) {
+		return false
+	}
+
+	if r.OwnerID != 0 && r.OwnerID != room.Owner.ID {
+		return false
+	}
+
+	if r.MinAgeDays != 0 && (daysSinceCreated == -1 || daysSinceCreated < r.MinAgeDays) {
+		return false
+	}
+
+	if r.MaxAgeDays != 0 && (daysSinceCreated == -1 || daysSinceCreated > r.MaxAgeDays) {
+		return false
+	}
+
+	return true
+}
+
+// isGuestAccessible returns true if guest access is enabled for the room. hipchat.Room.IsGuestAccessible is never
+// populated since its json tag is misspelled, so we rely on the guest access url instead.
+func isGuestAccessible(room *hipchat.Room) bool {
+	return room.IsGuestAccessible || room.GuestAccessURL != ""
+}
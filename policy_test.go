@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/tbruyelle/hipchat-go/hipchat"
+)
+
+func TestDecide(t *testing.T) {
+	guests := true
+
+	configuration := TenantConfiguration{
+		ID:        "tenant",
+		Threshold: 90,
+		Policy: Policy{
+			{Name: "on-call", NameGlob: "OnCall-*", Action: ActionArchive, Days: 3},
+			{Name: "projects", NameRegex: "^proj-[0-9]+$", Action: ActionArchive, Days: 180},
+			{Name: "guests", GuestAccess: &guests, Action: ActionNotify, Days: 30},
+			{Name: "ceo", OwnerID: 42, Privacy: "private", Action: ActionNever},
+			{Name: "legal", Topic: "Legal Hold", Action: ActionNever},
+			{Name: "new", MaxAgeDays: 7, Action: ActionNever},
+		},
+	}
+
+	var decideTests = []struct {
+		room             hipchat.Room
+		daysSinceCreated int
+		action           PolicyAction
+		threshold        int
+	}{
+		{hipchat.Room{Name: "oncall-payments"}, -1, ActionArchive, 3},
+		{hipchat.Room{Name: "proj-123"}, -1, ActionArchive, 180},
+		{hipchat.Room{Name: "proj-abc"}, -1, ActionArchive, 90},
+		{hipchat.Room{Name: "partners", GuestAccessURL: "https://hipchat.com/g123"}, -1, ActionNotify, 30},
+		{hipchat.Room{Name: "staff", Privacy: "private", Owner: hipchat.User{ID: 42}}, -1, ActionNever, 0},
+		{hipchat.Room{Name: "staff", Privacy: "public", Owner: hipchat.User{ID: 42}}, -1, ActionArchive, 90},
+		{hipchat.Room{Name: "contracts", Topic: "Under LEGAL HOLD until further notice"}, -1, ActionNever, 0},
+		{hipchat.Room{Name: "launch"}, 3, ActionNever, 0},
+		{hipchat.Room{Name: "launch"}, 30, ActionArchive, 90},
+		{hipchat.Room{Name: "launch"}, -1, ActionArchive, 90},
+		{hipchat.Room{Name: ""}, -1, ActionArchive, 90},
+	}
+
+	for _, tt := range decideTests {
+		decision := configuration.Decide(&tt.room, tt.daysSinceCreated, false)
+		if decision.Action != tt.action || decision.Threshold != tt.threshold {
+			t.Error(fmt.Sprintf("Decide was wrong. Expected=%s/%d Actual=%s/%d Room=%s", tt.action, tt.threshold, decision.Action, decision.Threshold, tt.room.Name))
+		}
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	var validateTests = []struct {
+		rule  PolicyRule
+		valid bool
+	}{
+		{PolicyRule{Action: ActionArchive, Days: 3}, true},
+		{PolicyRule{Action: ActionNever}, true},
+		{PolicyRule{Action: ActionNotify, Days: 30, NameGlob: "team-*"}, true},
+		{PolicyRule{Action: ActionArchive}, false},
+		{PolicyRule{Action: "delete", Days: 3}, false},
+		{PolicyRule{Action: ActionNever, NameGlob: "team-["}, false},
+		{PolicyRule{Action: ActionNever, NameRegex: "team-("}, false},
+		{PolicyRule{Action: ActionNever, Privacy: "secret"}, false},
+	}
+
+	for _, tt := range validateTests {
+		err := Policy{tt.rule}.Validate()
+		if (err == nil) != tt.valid {
+			t.Error(fmt.Sprintf("Validate was wrong. Expected=%v Actual=%v Rule=%+v", tt.valid, err, tt.rule))
+		}
+	}
+}
+
+func TestDecidePrivacyThresholds(t *testing.T) {
+	configuration := TenantConfiguration{
+		ID:               "tenant",
+		Threshold:        90,
+		PrivateThreshold: 30,
+		GuestThreshold:   7,
+		Policy:           Policy{{Name: "on-call", NameGlob: "oncall-*", Action: ActionArchive, Days: 3}},
+	}
+
+	var decideTests = []struct {
+		room      hipchat.Room
+		threshold int
+	}{
+		{hipchat.Room{Name: "general", Privacy: "public"}, 90},
+		{hipchat.Room{Name: "staff", Privacy: "private"}, 30},
+		{hipchat.Room{Name: "partners", Privacy: "public", GuestAccessURL: "https://hipchat.com/g123"}, 7},
+		{hipchat.Room{Name: "partners", Privacy: "private", GuestAccessURL: "https://hipchat.com/g123"}, 7},
+		{hipchat.Room{Name: "oncall-guests", Privacy: "private", GuestAccessURL: "https://hipchat.com/g123"}, 3},
+	}
+
+	for _, tt := range decideTests {
+		decision := configuration.Decide(&tt.room, -1, false)
+		if decision.Threshold != tt.threshold {
+			t.Error(fmt.Sprintf("Decide was wrong. Expected=%d Actual=%d Room=%s", tt.threshold, decision.Threshold, tt.room.Name))
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chakrit/go-bunyan"
+	"github.com/tbruyelle/hipchat-go/hipchat"
+)
+
+const (
+	// maxRateLimitedRetries is how many times a request that got a 429 is sent again
+	maxRateLimitedRetries = 5
+	// defaultRetryAfter is how long we wait after a 429 that doesn't say how long to wait
+	defaultRetryAfter = 10 * time.Second
+)
+
+// TokenBucket spreads the requests of all the room processors of a tenant over time. It holds up to burst tokens,
+// refilled at requestsPerMinute, and every request takes one. HipChat can also tell us to stop for a while, which
+// pauses the bucket.
+type TokenBucket struct {
+	mutex       sync.Mutex
+	clock       clock
+	sleep       func(context.Context, time.Duration) error
+	rate        float64
+	burst       float64
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+	waited      time.Duration
+}
+
+// NewTokenBucket returns a full bucket. It never makes requests wait unless it's paused if requestsPerMinute is 0.
+func NewTokenBucket(requestsPerMinute int, burst int) *TokenBucket {
+	return newTokenBucket(&realClock{}, sleepContext, requestsPerMinute, burst)
+}
+
+func newTokenBucket(c clock, sleep func(context.Context, time.Duration) error, requestsPerMinute int, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &TokenBucket{
+		clock:  c,
+		sleep:  sleep,
+		rate:   float64(requestsPerMinute) / 60,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   c.Now(),
+	}
+}
+
+// Wait blocks until the caller can make a request. It returns the error of ctx if ctx is done first.
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	wait := b.reserve()
+	if wait > 0 {
+		return b.sleep(ctx, wait)
+	}
+
+	return ctx.Err()
+}
+
+// sleepContext sleeps for the duration, or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reserve takes a token, and returns how long the caller has to wait until it's available
+func (b *TokenBucket) reserve() time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := b.clock.Now()
+
+	var wait time.Duration
+	if now.Before(b.pausedUntil) {
+		wait = b.pausedUntil.Sub(now)
+	}
+
+	if b.rate == 0 {
+		b.waited += wait
+		return wait
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens--
+	if b.tokens < 0 {
+		tokenWait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+		if tokenWait > wait {
+			wait = tokenWait
+		}
+	}
+
+	b.waited += wait
+	return wait
+}
+
+// PauseUntil makes every request wait until the given time
+func (b *TokenBucket) PauseUntil(until time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if until.After(b.pausedUntil) {
+		b.pausedUntil = until
+	}
+}
+
+// RateLimitState is what the rate limited client knows about the HipChat rate limit of a tenant
+type RateLimitState struct {
+	// Limit and Remaining are the size of the budget and the requests left in it, as of the last response. Reset is
+	// when the budget is refilled.
+	Limit     int
+	Remaining int
+	Reset     time.Time
+	// Requests is how many requests were sent, TooManyRequests how many of them got a 429, and Pauses how many
+	// times we stopped sending requests because the budget was used up
+	Requests        int
+	TooManyRequests int
+	Pauses          int
+	// Waited is the total time the requests waited for the budget
+	Waited time.Duration
+}
+
+// rateLimitedClient takes a token from the bucket before every request, and keeps track of the rate limit headers of
+// HipChat. When the budget is used up, it pauses the bucket until it's reset. When HipChat answers with a 429, it
+// pauses the bucket for as long as Retry-After says, and sends the request again. Requests waiting for the bucket fail
+// with the error of ctx once it's done.
+type rateLimitedClient struct {
+	ctx    context.Context
+	client hipchat.HTTPClient
+	bucket *TokenBucket
+	log    bunyan.Log
+
+	mutex sync.Mutex
+	state RateLimitState
+}
+
+func newRateLimitedClient(ctx context.Context, client hipchat.HTTPClient, bucket *TokenBucket, log bunyan.Log) *rateLimitedClient {
+	return &rateLimitedClient{ctx: ctx, client: client, bucket: bucket, log: log}
+}
+
+func (c *rateLimitedClient) Do(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for retry := 0; ; retry++ {
+		if body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		if err := c.bucket.Wait(c.ctx); err != nil {
+			return nil, err
+		}
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return resp, err
+		}
+
+		c.track(resp)
+		if resp.StatusCode != http.StatusTooManyRequests || retry == maxRateLimitedRetries {
+			return resp, err
+		}
+
+		resp.Body.Close()
+		wait := retryAfter(resp)
+		c.log.Infof("Got a 429 from HipChat, waiting %s before retrying", wait)
+		c.bucket.PauseUntil(c.bucket.clock.Now().Add(wait))
+	}
+}
+
+// State returns what we know about the rate limit
+func (c *rateLimitedClient) State() RateLimitState {
+	c.bucket.mutex.Lock()
+	waited := c.bucket.waited
+	c.bucket.mutex.Unlock()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	state := c.state
+	state.Waited = waited
+	return state
+}
+
+// track updates the state with the rate limit headers of the response, and pauses the bucket until the budget is
+// reset if there is nothing left in it
+func (c *rateLimitedClient) track(resp *http.Response) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.state.Requests++
+	if resp.StatusCode == http.StatusTooManyRequests {
+		c.state.TooManyRequests++
+	}
+
+	remaining, err := strconv.Atoi(resp.Header.Get("X-Ratelimit-Remaining"))
+	if err != nil {
+		return
+	}
+
+	c.state.Remaining = remaining
+	if limit, err := strconv.Atoi(resp.Header.Get("X-Ratelimit-Limit")); err == nil {
+		c.state.Limit = limit
+	}
+
+	if reset, err := strconv.ParseInt(resp.Header.Get("X-Ratelimit-Reset"), 10, 64); err == nil {
+		c.state.Reset = time.Unix(reset, 0)
+	}
+
+	if remaining > 0 || !c.state.Reset.After(c.bucket.clock.Now()) {
+		return
+	}
+
+	c.state.Pauses++
+	c.log.Infof("Used up the HipChat rate limit of %d requests, waiting until %s", c.state.Limit, c.state.Reset)
+	c.bucket.PauseUntil(c.state.Reset)
+}
+
+// retryAfter returns how long the Retry-After header of the response says to wait
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return defaultRetryAfter
+	}
+
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chakrit/go-bunyan"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC)
+
+	var bucketTests = []struct {
+		requestsPerMinute int
+		burst             int
+		pause             time.Duration
+		expected          []time.Duration
+	}{
+		{0, 1, 0, []time.Duration{0, 0, 0}},
+		{60, 2, 0, []time.Duration{0, 0, time.Second, 2 * time.Second}},
+		{120, 1, 0, []time.Duration{0, 500 * time.Millisecond, time.Second}},
+		{0, 1, 5 * time.Second, []time.Duration{5 * time.Second, 5 * time.Second}},
+		{60, 1, 5 * time.Second, []time.Duration{5 * time.Second, 5 * time.Second}},
+	}
+
+	for _, tt := range bucketTests {
+		clock := &testClock{start}
+		var waits []time.Duration
+		bucket := newTokenBucket(clock, func(ctx context.Context, d time.Duration) error { waits = append(waits, d); return nil }, tt.requestsPerMinute, tt.burst)
+		if tt.pause > 0 {
+			bucket.PauseUntil(start.Add(tt.pause))
+		}
+
+		var actual []time.Duration
+		for range tt.expected {
+			actual = append(actual, bucket.reserve())
+		}
+
+		if fmt.Sprint(actual) != fmt.Sprint(tt.expected) {
+			t.Error(fmt.Sprintf("TokenBucket waits were wrong. Expected=%v Actual=%v RequestsPerMinute=%d Burst=%d", tt.expected, actual, tt.requestsPerMinute, tt.burst))
+		}
+	}
+}
+
+// rateLimitedServer answers with 429s to the first tooManyRequests requests, and then with the rate limit headers of
+// a budget of limit requests per minute
+type rateLimitedServer struct {
+	sync.Mutex
+	clock           *testClock
+	tooManyRequests int
+	limit           int
+	remaining       int
+	reset           time.Time
+	requests        int
+}
+
+func (s *rateLimitedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	s.requests++
+
+	if s.tooManyRequests > 0 {
+		s.tooManyRequests--
+		w.Header().Set("Retry-After", "2")
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	now := s.clock.Now()
+	if !now.Before(s.reset) {
+		s.remaining = s.limit
+		s.reset = now.Add(time.Minute)
+	}
+
+	if s.remaining == 0 {
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	s.remaining--
+	w.Header().Set("X-Ratelimit-Limit", strconv.Itoa(s.limit))
+	w.Header().Set("X-Ratelimit-Remaining", strconv.Itoa(s.remaining))
+	w.Header().Set("X-Ratelimit-Reset", strconv.FormatInt(s.reset.Unix(), 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestRateLimitedClient(t *testing.T) {
+	start := time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC)
+
+	var clientTests = []struct {
+		tooManyRequests int
+		limit           int
+		requests        int
+		expected        RateLimitState
+	}{
+		{0, 100, 10, RateLimitState{Limit: 100, Remaining: 90, Requests: 10}},
+		{3, 100, 1, RateLimitState{Limit: 100, Remaining: 99, Requests: 4, TooManyRequests: 3, Waited: 6 * time.Second}},
+		{0, 5, 12, RateLimitState{Limit: 5, Remaining: 3, Requests: 12, Pauses: 2, Waited: 2 * time.Minute}},
+		{10, 5, 1, RateLimitState{Requests: 6, TooManyRequests: 6, Waited: 10 * time.Second}},
+	}
+
+	for _, tt := range clientTests {
+		clock := &testClock{start}
+		server := &rateLimitedServer{clock: clock, tooManyRequests: tt.tooManyRequests, limit: tt.limit}
+		httpServer := httptest.NewServer(server)
+
+		bucket := newTokenBucket(clock, func(ctx context.Context, d time.Duration) error { clock.time = clock.time.Add(d); return nil }, 0, 1)
+		client := newRateLimitedClient(context.Background(), http.DefaultClient, bucket, bunyan.NewStdLogger("test", bunyan.NilSink()))
+
+		var lastStatus int
+		for i := 0; i < tt.requests; i++ {
+			req, _ := http.NewRequest("PUT", httpServer.URL, strings.NewReader("body"))
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			lastStatus = resp.StatusCode
+		}
+
+		httpServer.Close()
+
+		state := client.State()
+		state.Reset = time.Time{}
+		if state != tt.expected {
+			t.Error(fmt.Sprintf("Rate limit state was wrong. Expected=%+v Actual=%+v LastStatus=%d", tt.expected, state, lastStatus))
+		}
+	}
+}
+
+func TestRateLimitedClientStopsWaitingWhenDone(t *testing.T) {
+	clock := &testClock{time.Now()}
+	server := &rateLimitedServer{clock: clock, limit: 100}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	bucket := newTokenBucket(clock, sleepContext, 0, 1)
+	bucket.PauseUntil(clock.Now().Add(time.Hour))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client := newRateLimitedClient(ctx, http.DefaultClient, bucket, bunyan.NewStdLogger("test", bunyan.NilSink()))
+
+	done := make(chan error)
+	go func() {
+		req, _ := http.NewRequest("GET", httpServer.URL, nil)
+		_, err := client.Do(req)
+		done <- err
+	}()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("The request waiting for the bucket was wrong. Expected=%v Actual=%v", context.Canceled, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The request kept waiting for the bucket after the context was done")
+	}
+
+	server.Lock()
+	defer server.Unlock()
+	if server.requests != 0 {
+		t.Errorf("The request was sent. Expected=0 requests Actual=%d", server.requests)
+	}
+}
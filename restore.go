@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"bitbucket.org/rbergman/go-hipchat-connect/store"
+	"bitbucket.org/rbergman/go-hipchat-connect/util"
+	machinery "github.com/RichardKnop/machinery/v1"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	restoresStoreKey = "restores"
+	// restoreProgressInterval is how many rooms are restored between progress reports
+	restoreProgressInterval = 10
+)
+
+// RestoreProgress is how far the restore of the rooms archived by a job, or during a time range, got. Every tenant has
+// one restore at a time.
+type RestoreProgress struct {
+	TaskUUID string
+	JobID    string `json:",omitempty"`
+	From     time.Time
+	To       time.Time
+	// Total is how many rooms are being restored, Restored and Failed how many of them were already
+	Total      int
+	Restored   int
+	Failed     int
+	StartedAt  time.Time
+	UpdatedAt  time.Time
+	FinishedAt time.Time
+	Finished   bool
+	Error      string `json:",omitempty"`
+}
+
+// Restores keeps the progress of the latest restore of every tenant
+type Restores struct {
+	store store.Store
+}
+
+func (s *Server) NewRestores() *Restores {
+	return newRestores(s.NewTenantStore(restoresStoreKey))
+}
+
+func newRestores(s store.Store) *Restores {
+	return &Restores{store: s}
+}
+
+// Get returns the progress of the latest restore of the tenant, or nil if there wasn't one
+func (r *Restores) Get(tenantID string) (*RestoreProgress, error) {
+	value, err := r.store.Get(tenantID)
+	if err != nil || len(value) == 0 {
+		return nil, err
+	}
+
+	progress := &RestoreProgress{}
+	err = json.Unmarshal(value, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	return progress, nil
+}
+
+// Set saves the progress of the restore of the tenant, for as long as the results of the tasks are kept
+func (r *Restores) Set(tenantID string, progress *RestoreProgress) error {
+	value, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+
+	return r.store.SetEx(tenantID, value, taskResultsTTL())
+}
+
+// isRunning returns true if the restore didn't finish yet. A restore that hasn't reported any progress for
+// resultTimeout is given up on, since its worker is gone.
+func (p *RestoreProgress) isRunning(now time.Time) bool {
+	return p != nil && !p.Finished && now.Sub(p.UpdatedAt) < resultTimeout
+}
+
+// ArchivedRooms returns the rooms archived by the job, or by the jobs that archived rooms between from and to if jobID
+// is empty. Dry runs didn't archive anything, so they are ignored.
+func (h *JobHistory) ArchivedRooms(tenantID string, jobID string, from time.Time, to time.Time, now time.Time) ([]AuditEntry, error) {
+	jobs, err := h.Jobs(tenantID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[int]bool{}
+	var rooms []AuditEntry
+	for _, job := range jobs {
+		if job.DryRun || (jobID != "" && job.JobID != jobID) {
+			continue
+		}
+
+		if jobID == "" && (job.FinishedAt.Before(from) || job.StartedAt.After(to)) {
+			continue
+		}
+
+		entries, err := h.Entries(tenantID, job.JobID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if entry.Action != auditActions[roomArchived] || seen[entry.RoomID] {
+				continue
+			}
+
+			if jobID == "" && (entry.At.Before(from) || entry.At.After(to)) {
+				continue
+			}
+
+			seen[entry.RoomID] = true
+			rooms = append(rooms, entry)
+		}
+	}
+
+	return rooms, nil
+}
+
+// UnarchiveRoom calls the hipchat API to unarchive a room that we archived. Since the state of the room still says we
+// archived it, the next job gives it the unarchive cooldown.
+func (j *Job) UnarchiveRoom(roomID int) error {
+	room, err := j.GetRoom(roomID)
+	if err != nil {
+		j.Log.Record("rid", roomID).Errorf("Client.Room.Get returned an error %v", err)
+		return err
+	}
+
+	if !room.IsArchived {
+		j.Log.Record("rid", roomID).Infof("Room is not archived, nothing to restore")
+		return nil
+	}
+
+	room.IsArchived = false
+	updateRequest := newUpdateRoomRequest(room)
+
+	resp, err := j.Client.Room.Update(strconv.Itoa(roomID), &updateRequest)
+	if err != nil {
+		j.Log.Record("rid", roomID).Errorf("Client.Room.Update returned an error when unarchiving %v", resp)
+		return err
+	}
+
+	j.Log.Record("rid", roomID).Infof("Unarchived room")
+	return nil
+}
+
+// restoreRooms unarchives the rooms, and reports its progress every restoreProgressInterval rooms and once it's done.
+// It stops if the lock of the tenant is lost.
+func (j *Job) restoreRooms(rooms []AuditEntry, progress *RestoreProgress, report func(*RestoreProgress)) {
+	progress.Total = len(rooms)
+	report(progress)
+
+	for i, room := range rooms {
+		if !j.holdsLock() {
+			j.Log.Errorf("Lost the lock of the tenant, stopping after %d rooms", i)
+			progress.Error = "The restore was interrupted"
+			break
+		}
+
+		if err := j.UnarchiveRoom(room.RoomID); err != nil {
+			progress.Failed++
+		} else {
+			progress.Restored++
+		}
+
+		if (i+1)%restoreProgressInterval == 0 {
+			report(progress)
+		}
+	}
+
+	progress.Finished = true
+	progress.FinishedAt = j.Clock.Now()
+	report(progress)
+}
+
+// restoreArchivedRooms is the restoreRooms task. It unarchives the rooms archived by the job, or between from and to
+// if jobID is empty, while holding the lock of the tenant. It returns the final progress of the restore as JSON. A
+// task delivered again once its restore finished, or after another restore started, doesn't run again.
+func (server *Server) restoreArchivedRooms(tenantID string, jobID string, from string, to string, taskUUID string) (string, error) {
+	fromTime, _ := time.Parse(time.RFC3339, from)
+	toTime, _ := time.Parse(time.RFC3339, to)
+
+	restores := server.NewRestores()
+	progress := &RestoreProgress{TaskUUID: taskUUID, JobID: jobID, From: fromTime, To: toTime, StartedAt: time.Now()}
+	started, err := restores.Get(tenantID)
+	if err != nil {
+		server.Log.Errorf("Couldn't get the progress of the restore of tid-%s: %s", tenantID, err)
+	} else if started != nil && (started.TaskUUID != taskUUID || started.Finished) {
+		server.Log.Infof("Not running the restore %s of tid-%s again, it's finished or was superseded by %s", taskUUID, tenantID, started.TaskUUID)
+		value, err := json.Marshal(started)
+		return string(value), err
+	} else if started != nil {
+		progress.StartedAt = started.StartedAt
+	}
+
+	report := func(progress *RestoreProgress) {
+		progress.UpdatedAt = time.Now()
+		if err := restores.Set(tenantID, progress); err != nil {
+			server.Log.Errorf("Couldn't save the progress of the restore of tid-%s: %s", tenantID, err)
+		}
+	}
+
+	failed := func(format string, args ...interface{}) (string, error) {
+		progress.Error = fmt.Sprintf(format, args...)
+		progress.Finished = true
+		progress.FinishedAt = time.Now()
+		report(progress)
+		server.Log.Errorf("Couldn't restore the rooms of tid-%s: %s", tenantID, progress.Error)
+		return "", errors.New(progress.Error)
+	}
+
+	lock, err := server.AcquireTenantLock(tenantID, lockTTL)
+	if err != nil {
+		return failed("Couldn't lock the tenant: %v", err)
+	} else if lock == nil {
+		return failed("The rooms are being processed, try again once they are done")
+	}
+	defer lock.Release()
+
+	tenant, err := server.NewTenants().Get(tenantID)
+	if err != nil {
+		return failed("Couldn't find the tenant")
+	}
+
+	rooms, err := server.NewJobHistory().ArchivedRooms(tenantID, jobID, fromTime, toTime, time.Now())
+	if err != nil {
+		return failed("Couldn't get the archived rooms: %v", err)
+	}
+
+	worker := Worker{Log: server.Log.Record("jid", uuid.NewV4().String()).Record("tid", tenantID).Child()}
+	job := &Job{
+		Log:        worker.Log,
+		TenantID:   tenantID,
+		Clock:      &realClock{},
+		HipChatURL: tenant.Links.Base,
+		Lock:       lock,
+	}
+
+	bucket := NewTokenBucket(util.Env.GetIntOr("REQUESTS_PER_MINUTE", 0), util.Env.GetIntOr("REQUESTS_BURST", 10))
+	job.HTTPClient = newRateLimitedClient(context.Background(), worker.newHTTPClient(), bucket, job.Log)
+	job.Client, err = worker.getClient(tenant, job.HTTPClient)
+	if err != nil {
+		return failed("Couldn't get a token: %v", err)
+	}
+
+	job.Log.Infof("Restoring %d rooms", len(rooms))
+	job.restoreRooms(rooms, progress, report)
+	job.Log.Infof("Restored %d rooms, %d failed", progress.Restored, progress.Failed)
+
+	value, err := json.Marshal(progress)
+	return string(value), err
+}
+
+// startRestore enqueues the restore of the rooms archived by the job, or between from and to if jobID is empty. The
+// dates are either YYYY-MM-DD or RFC3339.
+func (s *Server) startRestore(taskServer *machinery.Server, tenantID string, jobID string, from string, to string) (int, error) {
+	var fromTime, toTime time.Time
+	if jobID == "" {
+		var err error
+		fromTime, err = parseRestoreTime(from, false)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+
+		toTime, err = parseRestoreTime(to, true)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+
+		if toTime.Before(fromTime) {
+			return http.StatusBadRequest, fmt.Errorf("The end of the time range is before its start")
+		}
+	}
+
+	if progress, err := s.NewRestores().Get(tenantID); err == nil && progress.isRunning(time.Now()) {
+		return http.StatusConflict, fmt.Errorf("A restore is already running")
+	}
+
+	status, err := s.allowManualRun(tenantID, "restore")
+	if err != nil {
+		return status, err
+	}
+
+	// the progress is saved before the task is enqueued, so the task always finds it and can't be overwritten by it
+	restores := s.NewRestores()
+	now := time.Now()
+	progress := &RestoreProgress{TaskUUID: "task_" + uuid.NewV4().String(), JobID: jobID, From: fromTime, To: toTime, StartedAt: now, UpdatedAt: now}
+	if err := restores.Set(tenantID, progress); err != nil {
+		s.Log.Errorf("Couldn't save the progress of the restore of tid-%s: %s", tenantID, err)
+		s.releaseManualRun(tenantID, "restore")
+		return http.StatusInternalServerError, fmt.Errorf("Internal Server Error")
+	}
+
+	task := newTaskSignature(restoreRoomsTask, tenantID, jobID, formatRestoreTime(fromTime), formatRestoreTime(toTime), progress.TaskUUID)
+	task.UUID = progress.TaskUUID
+	if _, err := s.publishTask(taskServer, tenantID, task); err != nil {
+		progress.Error = "The restore couldn't be started"
+		progress.Finished = true
+		progress.FinishedAt = time.Now()
+		if err := restores.Set(tenantID, progress); err != nil {
+			s.Log.Errorf("Couldn't save the progress of the restore of tid-%s: %s", tenantID, err)
+		}
+
+		s.releaseManualRun(tenantID, "restore")
+		return http.StatusInternalServerError, fmt.Errorf("Couldn't start the restore")
+	}
+
+	return http.StatusOK, nil
+}
+
+// parseRestoreTime parses a RFC3339 time, or a YYYY-MM-DD date that starts the range, or ends it if endOfDay is true
+func parseRestoreTime(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	date, err := time.Parse(dateFormat, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("'%s' is neither YYYY-MM-DD nor RFC3339", value)
+	}
+
+	if endOfDay {
+		return date.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+	}
+
+	return date, nil
+}
+
+// formatRestoreTime formats a bound of the time range for the task, which gets an empty one when restoring a job
+func formatRestoreTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.Format(time.RFC3339Nano)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tbruyelle/hipchat-go/hipchat"
+)
+
+func TestArchivedRooms(t *testing.T) {
+	start := time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC)
+	history := newJobHistory(newMemoryStore(), newMemoryStore(), 30*24*time.Hour)
+
+	history.Add("tenant", JobRecord{JobID: "first", StartedAt: start, FinishedAt: start}, []AuditEntry{
+		{RoomID: 1, Action: "archived", At: start},
+		{RoomID: 2, Action: "warned", At: start},
+	})
+	history.Add("tenant", JobRecord{JobID: "dry", StartedAt: start.AddDate(0, 0, 1), FinishedAt: start.AddDate(0, 0, 1), DryRun: true}, []AuditEntry{
+		{RoomID: 3, Action: "archived", At: start.AddDate(0, 0, 1)},
+	})
+	history.Add("tenant", JobRecord{JobID: "second", StartedAt: start.AddDate(0, 0, 2), FinishedAt: start.AddDate(0, 0, 2)}, []AuditEntry{
+		{RoomID: 4, Action: "archived", At: start.AddDate(0, 0, 2)},
+		{RoomID: 5, Action: "archived", At: start.AddDate(0, 0, 2)},
+	})
+
+	tests := []struct {
+		jobID    string
+		from     time.Time
+		to       time.Time
+		expected []int
+	}{
+		{jobID: "first", expected: []int{1}},
+		{jobID: "dry", expected: nil},
+		{from: start, to: start.AddDate(0, 0, 3), expected: []int{4, 5, 1}},
+		{from: start.AddDate(0, 0, 1), to: start.AddDate(0, 0, 3), expected: []int{4, 5}},
+	}
+
+	for _, tt := range tests {
+		entries, err := history.ArchivedRooms("tenant", tt.jobID, tt.from, tt.to, start.AddDate(0, 0, 3))
+		var rooms []int
+		for _, entry := range entries {
+			rooms = append(rooms, entry.RoomID)
+		}
+
+		if err != nil || fmt.Sprint(rooms) != fmt.Sprint(tt.expected) {
+			t.Error(fmt.Sprintf("Archived rooms were wrong. Job=%s From=%s To=%s Expected=%v Actual=%v Error=%v", tt.jobID, tt.from, tt.to, tt.expected, rooms, err))
+		}
+	}
+}
+
+func TestRestoreRooms(t *testing.T) {
+	start := time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC)
+	clock := &testClock{start}
+	hipChat := newFakeHipChat(clock)
+	defer hipChat.server.Close()
+
+	hipChat.addRoom(hipchat.Room{ID: 1, Name: "archived", IsArchived: true}, hipchat.RoomStatistics{})
+	hipChat.addRoom(hipchat.Room{ID: 2, Name: "unarchived", IsArchived: false}, hipchat.RoomStatistics{})
+	hipChat.addRoom(hipchat.Room{ID: 3, Name: "other", IsArchived: true}, hipchat.RoomStatistics{})
+
+	job := newTestJob(clock, hipChat)
+	job.States.Set(1, &RoomState{ArchivedAt: start.AddDate(0, 0, -1)})
+
+	// Room 4 was deleted since it was archived
+	rooms := []AuditEntry{{RoomID: 1}, {RoomID: 2}, {RoomID: 4}}
+	progress := &RestoreProgress{}
+	reports := 0
+	job.restoreRooms(rooms, progress, func(*RestoreProgress) { reports++ })
+
+	if progress.Total != 3 || progress.Restored != 2 || progress.Failed != 1 || !progress.Finished || reports != 2 {
+		t.Error(fmt.Sprintf("Progress was wrong. Expected=2/3 restored, 1 failed, finished after 2 reports Actual=%+v after %d reports", progress, reports))
+	}
+
+	if hipChat.rooms[1].IsArchived || !hipChat.rooms[3].IsArchived {
+		t.Error(fmt.Sprintf("Rooms weren't restored. Expected=room 1 unarchived, room 3 archived Actual=%+v, %+v", hipChat.rooms[1], hipChat.rooms[3]))
+	}
+
+	// The restored room gets the unarchive cooldown, like the rooms that someone else unarchived
+	if outcome := job.processRoom(hipChat.rooms[1], &TenantConfiguration{Threshold: 1}, nil); outcome == roomArchived {
+		t.Error("Restored room was archived again")
+	}
+}
+
+func TestFinishedRestoreIsNotRunAgain(t *testing.T) {
+	start := time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC)
+	s := newFakeRedisServer(newFakeRedis(&testClock{start}))
+
+	finished := &RestoreProgress{TaskUUID: "task_1", JobID: "job", Total: 2, Restored: 2, StartedAt: start, UpdatedAt: start, FinishedAt: start, Finished: true}
+	if err := s.NewRestores().Set("tenant", finished); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []string{"task_1", "task_0"}
+	for _, taskUUID := range tests {
+		if _, err := s.restoreArchivedRooms("tenant", "job", "", "", taskUUID); err != nil {
+			t.Error(fmt.Sprintf("The restore %s failed: %v", taskUUID, err))
+		}
+
+		progress, err := s.NewRestores().Get("tenant")
+		if err != nil || fmt.Sprint(progress) != fmt.Sprint(finished) {
+			t.Error(fmt.Sprintf("The progress was overwritten by the restore %s. Expected=%+v Actual=%+v Error=%v", taskUUID, finished, progress, err))
+		}
+	}
+}
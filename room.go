@@ -14,42 +14,103 @@ import (
 const (
 	// See http://golang.org/pkg/time/#Parse
 	timeFormat = "2006-01-02T15:04:05+00:00"
+	// dateFormat is how the dates of the topic directives, the settings and the restores are written
+	dateFormat = "2006-01-02"
 )
 
-const (
-	topic = "do not archive"
-)
+const topic = "do not archive"
+
+// roomListExpansion asks the room list API to return the full rooms, with their statistics, instead of only their
+// names and IDs. This saves us from getting the details and the statistics of every room separately.
+const roomListExpansion = "items,items.statistics"
 
 type options struct {
-	StartIndex int `url:"start-index"`
-	MaxResults int `url:"max-results"`
+	hipchat.ListOptions
+	IncludePrivate  bool   `url:"include-private,omitempty"`
+	IncludeArchived bool   `url:"include-archived,omitempty"`
+	Expand          string `url:"expand,omitempty"`
+}
+
+// listedRooms is a page of the expanded room list
+type listedRooms struct {
+	Items []listedRoom      `json:"items"`
+	Links hipchat.PageLinks `json:"links"`
+}
+
+// listedRoom is a room of the expanded room list. Its statistics are decoded on their own, to tell the rooms without
+// messages apart from the rooms whose statistics weren't included.
+type listedRoom struct {
+	hipchat.Room
+	Statistics *struct {
+		MessagesSent *int   `json:"messages_sent"`
+		LastActive   string `json:"last_active"`
+	} `json:"statistics"`
 }
 
 // GetRooms retrieves all the active rooms for a specific tenant. This function calls the HipChat /room API, batching
 // results in groups of 1000.
 // It returns a list of rooms, and or any errors.
 func (j *Job) GetRooms() ([]hipchat.Room, error) {
+	return j.listRooms(false)
+}
+
+// GetArchivedRooms retrieves all the archived rooms for a specific tenant
+func (j *Job) GetArchivedRooms() ([]hipchat.Room, error) {
+	rooms, err := j.listRooms(true)
+
+	var archivedRooms []hipchat.Room
+	for _, room := range rooms {
+		if room.IsArchived {
+			archivedRooms = append(archivedRooms, room)
+		}
+	}
+
+	j.Log.Infof("Retrieved %d archived rooms", len(archivedRooms))
+	return archivedRooms, err
+}
+
+// listRooms retrieves the rooms with their details and statistics. The statistics are kept by the job, so processing
+// the rooms only asks HipChat for them when the list didn't include them.
+func (j *Job) listRooms(includeArchived bool) ([]hipchat.Room, error) {
 	var roomList []hipchat.Room
 	var response *http.Response
 	var err error
 	startIndex := 0
 	maxResults := 1000
+	statistics := map[int]*hipchat.RoomStatistics{}
 
 	for {
-		var rooms *hipchat.Rooms
-		opt := &hipchat.RoomsListOptions{
+		opt := &options{
 			ListOptions:     hipchat.ListOptions{StartIndex: startIndex, MaxResults: maxResults},
 			IncludePrivate:  true,
-			IncludeArchived: false}
+			IncludeArchived: includeArchived,
+			Expand:          roomListExpansion}
+
+		var req *http.Request
+		req, err = j.Client.NewRequest("GET", "room", opt, nil)
+		if err != nil {
+			break
+		}
 
-		rooms, response, err = j.Client.Room.List(opt)
+		rooms := &listedRooms{}
+		response, err = j.Client.Do(req, rooms)
 
 		if err != nil {
 			j.Log.Errorf("Client.CreateClient returns an error %v", response)
 			break
 		}
 
-		roomList = append(roomList, rooms.Items...)
+		for _, item := range rooms.Items {
+			room := item.Room
+			if item.Statistics != nil && item.Statistics.MessagesSent != nil {
+				room.Statistics.MessagesSent = *item.Statistics.MessagesSent
+				room.Statistics.LastActive = item.Statistics.LastActive
+				stats := room.Statistics
+				statistics[room.ID] = &stats
+			}
+
+			roomList = append(roomList, room)
+		}
 
 		if rooms.Links.Next == "" {
 			j.Log.Debugf("client.Room.List retreieved all the rooms")
@@ -59,7 +120,8 @@ func (j *Job) GetRooms() ([]hipchat.Room, error) {
 		}
 	}
 
-	j.Log.Infof("Retrieved %d rooms", len(roomList))
+	j.listedStatistics = statistics
+	j.Log.Infof("Retrieved %d rooms, %d with their statistics", len(roomList), len(statistics))
 	return roomList, err
 }
 
@@ -81,7 +143,41 @@ func (j *Job) ShouldArchiveRoom(roomID, daysSinceLastActive, threshold int, room
 	return shouldArchive
 }
 
-// TouchRoom sends a message to the room, so the last_active date won't be empty the next time the autoarchiver runs
+// ShouldWarnRoom returns true if a room will have to be archived in warningDays or less
+func (j *Job) ShouldWarnRoom(roomID, daysSinceLastActive, threshold, warningDays int, roomTopic string) bool {
+	return j.ShouldArchiveRoom(roomID, daysSinceLastActive+warningDays, threshold, roomTopic)
+}
+
+// IsOldEnoughToArchive returns false if the room was created less than minimumAgeDays ago, or if its topic asks to
+// keep it until a date that hasn't passed yet. Rooms whose age is unknown are only held back by their topic.
+func (j *Job) IsOldEnoughToArchive(roomID, daysSinceCreated, minimumAgeDays int, roomTopic string) bool {
+	if daysSinceCreated >= 0 && daysSinceCreated < minimumAgeDays {
+		j.Log.Record("rid", roomID).Infof("Skipping since it was created %d days ago, minimum age is %d days", daysSinceCreated, minimumAgeDays)
+		return false
+	}
+
+	after, ok := TopicArchiveAfter(roomTopic)
+	if ok && j.Clock.Now().Before(after.On.AddDate(0, 0, 1)) {
+		j.Log.Record("rid", roomID).Infof("Skipping due to topic directive '%s', can't be archived until after %s", after.Text, after.On.Format(dateFormat))
+		return false
+	}
+
+	return true
+}
+
+// WarnRoom lets the room know that it's going to be archived in daysUntilArchived days unless someone uses it
+func (j *Job) WarnRoom(roomID int, daysSinceLastActive int, daysUntilArchived int) {
+	message := fmt.Sprintf("This room has been inactive for %d days. It will be archived in %d days unless someone uses it.", daysSinceLastActive, daysUntilArchived)
+	if j.DryRun {
+		j.Log.Record("rid", roomID).Infof("Would've warned: %s", message)
+	} else {
+		j.notify(roomID, message)
+		j.Log.Record("rid", roomID).Infof("Warned room, idle for %d days", daysSinceLastActive)
+	}
+}
+
+// TouchRoom lets the room know that we can't tell how long it has been idle. It's only informational, the idle clock
+// of the room starts the first time we see it, and it isn't reset by this notification.
 func (j *Job) TouchRoom(roomID int, threshold int) {
 	if j.DryRun {
 		j.Log.Record("rid", roomID).Infof("Would've updated last_active")
@@ -91,27 +187,53 @@ func (j *Job) TouchRoom(roomID int, threshold int) {
 	}
 }
 
+// NotifyIdleRoom lets the room know it has been idle for a while, for rooms that the policy says shouldn't be archived
+func (j *Job) NotifyIdleRoom(roomID int, daysSinceLastActive int) {
+	message := fmt.Sprintf("This room has been inactive for %d days. Consider archiving it if it's no longer needed.", daysSinceLastActive)
+	if j.DryRun {
+		j.Log.Record("rid", roomID).Infof("Would've notified: %s", message)
+	} else {
+		j.notify(roomID, message)
+	}
+}
+
 // GetDaysSinceLastActive calculates how many days  has a room been inactive,
 // based on the current time and the value return from the Room Stats hipchat API
 func (j *Job) GetDaysSinceLastActive(roomID int, stats *hipchat.RoomStatistics) int {
 	var deltaInDays = -1
 
+	lastActive, ok := j.getLastActive(roomID, stats)
+	if ok {
+		delta := j.Clock.Now().Sub(lastActive)
+		j.Log.Record("rid", roomID).Debugf("Has been idle for %s", delta)
+		deltaInDays = daysBetween(lastActive, j.Clock.Now())
+		j.Log.Record("rid", roomID).Debugf("Has been idle for %d days", deltaInDays)
+	}
+
+	return deltaInDays
+}
+
+// HasBeenActiveSince returns true if the room stats show activity after the given time
+func (j *Job) HasBeenActiveSince(roomID int, stats *hipchat.RoomStatistics, since time.Time) bool {
+	lastActive, ok := j.getLastActive(roomID, stats)
+	return ok && lastActive.After(since)
+}
+
+// getLastActive parses the last active date of the room stats. It returns false if it's empty or not valid.
+func (j *Job) getLastActive(roomID int, stats *hipchat.RoomStatistics) (time.Time, bool) {
 	if stats.LastActive == "" {
 		j.Log.Record("rid", roomID).Debugf("last_active is empty")
-	} else {
-		j.Log.Record("rid", roomID).Debugf("last_active %v", stats.LastActive)
-		lastActive, err := time.Parse(timeFormat, stats.LastActive)
-		if err != nil {
-			j.Log.Record("rid", roomID).Errorf("Couldn't parse date error: %v", err)
-		} else {
-			delta := j.Clock.Now().Sub(lastActive)
-			j.Log.Record("rid", roomID).Debugf("Has been idle for %s", delta)
-			deltaInDays = int(delta.Hours() / 24) //assumes every day has 24 hours, not DST aware
-			j.Log.Record("rid", roomID).Debugf("Has been idle for %d days", deltaInDays)
-		}
+		return time.Time{}, false
 	}
 
-	return deltaInDays
+	j.Log.Record("rid", roomID).Debugf("last_active %v", stats.LastActive)
+	lastActive, err := time.Parse(timeFormat, stats.LastActive)
+	if err != nil {
+		j.Log.Record("rid", roomID).Errorf("Couldn't parse date error: %v", err)
+		return time.Time{}, false
+	}
+
+	return lastActive, true
 }
 
 // GetDaysSinceCreated calculates how many days since the room was created
@@ -137,6 +259,28 @@ func (j *Job) GetRoomStats(roomID int) (*hipchat.RoomStatistics, error) {
 	return stats, err
 }
 
+// getListedRoomStats returns the statistics of the room included in the room list, and only queries the hipchat api
+// for them if they weren't
+func (j *Job) getListedRoomStats(roomID int) (*hipchat.RoomStatistics, error) {
+	if stats, ok := j.listedStatistics[roomID]; ok {
+		return stats, nil
+	}
+
+	j.Log.Record("rid", roomID).Debugf("The room list didn't include the statistics")
+	return j.GetRoomStats(roomID)
+}
+
+// getRoomDetails returns the room if the room list included its details, and otherwise queries the hipchat api for
+// the full room object. Rooms always have a creation date, which the room list doesn't include unless it's expanded.
+func (j *Job) getRoomDetails(room *hipchat.Room) (*hipchat.Room, error) {
+	if room.Created != "" {
+		return room, nil
+	}
+
+	j.Log.Record("rid", room.ID).Debugf("The room list didn't include the details")
+	return j.GetRoom(room.ID)
+}
+
 // ArchiveRoom calls the hipchat API to archive the room. It sends a message while archiving so the owner of the room will know what
 // happened to her room.
 func (j *Job) ArchiveRoom(roomID int, daysSinceLastActive int) error {
@@ -151,15 +295,7 @@ func (j *Job) ArchiveRoom(roomID int, daysSinceLastActive int) error {
 	}
 
 	room.IsArchived = true
-	ownerID := hipchat.ID{ID: strconv.Itoa(room.Owner.ID)}
-	updateRequest := hipchat.UpdateRoomRequest{
-		Name:          room.Name,
-		Topic:         room.Topic,
-		IsGuestAccess: room.IsGuestAccessible,
-		IsArchived:    true,
-		Privacy:       room.Privacy,
-		Owner:         ownerID,
-	}
+	updateRequest := newUpdateRoomRequest(room)
 
 	message := fmt.Sprintf("Archiving the room since it has been inactive for %d days. Go to %s/rooms/archive/%d to unarchive it.", daysSinceLastActive, j.HipChatURL, roomID)
 
@@ -168,12 +304,14 @@ func (j *Job) ArchiveRoom(roomID int, daysSinceLastActive int) error {
 		j.Log.Record("rid", roomID).Infof("Would've archived: %s", message)
 	} else {
 		j.notify(roomID, message)
-		resp, err := j.Client.Room.Update(strconv.Itoa(roomID), &updateRequest)
+		response, err = j.Client.Room.Update(strconv.Itoa(roomID), &updateRequest)
 
 		if err != nil {
 			j.Log.Record("rid", roomID).Errorf("Client.Room.Update returned an error when archiving")
-			contents, _ := ioutil.ReadAll(resp.Body)
-			j.Log.Record("rid", roomID).Errorf("%s %s", contents, err)
+			if response != nil {
+				contents, _ := ioutil.ReadAll(response.Body)
+				j.Log.Record("rid", roomID).Errorf("%s %s", contents, err)
+			}
 		} else {
 			j.Log.Record("rid", roomID).Infof("Archived room, idle for %d days", daysSinceLastActive)
 		}
@@ -182,6 +320,58 @@ func (j *Job) ArchiveRoom(roomID int, daysSinceLastActive int) error {
 	return err
 }
 
+// DeleteRoom calls the hipchat API to permanently delete a room that we archived daysSinceArchived days ago
+func (j *Job) DeleteRoom(roomID int, daysSinceArchived int) error {
+	if j.DryRun {
+		j.Log.Record("rid", roomID).Infof("Would've deleted room, archived %d days ago", daysSinceArchived)
+		return nil
+	}
+
+	resp, err := j.Client.Room.Delete(strconv.Itoa(roomID))
+	if err != nil {
+		j.Log.Record("rid", roomID).Errorf("Client.Room.Delete returned an error %v", resp)
+		return err
+	}
+
+	j.Log.Record("rid", roomID).Infof("Deleted room, archived %d days ago", daysSinceArchived)
+	return nil
+}
+
+// DisableGuestAccess calls the hipchat API to turn off guest access for an idle room, ahead of archiving it
+func (j *Job) DisableGuestAccess(room *hipchat.Room, daysSinceLastActive int) error {
+	updateRequest := newUpdateRoomRequest(room)
+	updateRequest.IsGuestAccess = false
+
+	message := fmt.Sprintf("Disabling guest access since the room has been inactive for %d days.", daysSinceLastActive)
+
+	if j.DryRun {
+		j.Log.Record("rid", room.ID).Infof("Would've disabled guest access: %s", message)
+		return nil
+	}
+
+	j.notify(room.ID, message)
+	resp, err := j.Client.Room.Update(strconv.Itoa(room.ID), &updateRequest)
+	if err != nil {
+		j.Log.Record("rid", room.ID).Errorf("Client.Room.Update returned an error when disabling guest access %v", resp)
+		return err
+	}
+
+	j.Log.Record("rid", room.ID).Infof("Disabled guest access, idle for %d days", daysSinceLastActive)
+	return nil
+}
+
+// newUpdateRoomRequest returns a request that updates the room with its current values
+func newUpdateRoomRequest(room *hipchat.Room) hipchat.UpdateRoomRequest {
+	return hipchat.UpdateRoomRequest{
+		Name:          room.Name,
+		Topic:         room.Topic,
+		IsGuestAccess: isGuestAccessible(room),
+		IsArchived:    room.IsArchived,
+		Privacy:       room.Privacy,
+		Owner:         hipchat.ID{ID: strconv.Itoa(room.Owner.ID)},
+	}
+}
+
 // GetRoom calls the hipchat api to get the full room object
 func (j *Job) GetRoom(roomID int) (*hipchat.Room, error) {
 	room, _, err := j.Client.Room.Get(strconv.Itoa(roomID))
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+const overridesStoreKey = "overrides"
+
+// RoomOverrides manages the per room thresholds of the tenants
+type RoomOverrides struct {
+	server *Server
+}
+
+// RoomOverride replaces the threshold of the tenant for a single room. Exempt rooms are never archived.
+type RoomOverride struct {
+	RoomID    int
+	Threshold int
+	Exempt    bool
+}
+
+func (s *Server) NewRoomOverrides() *RoomOverrides {
+	return &RoomOverrides{server: s}
+}
+
+// Get returns the overrides of a tenant, indexed by room ID
+func (o *RoomOverrides) Get(tenantID string) (map[int]RoomOverride, error) {
+	overrides := map[int]RoomOverride{}
+
+	store := o.server.NewTenantStore(overridesStoreKey)
+	value, err := store.Get(tenantID)
+
+	if err != nil {
+		o.server.Log.Debugf("Error when getting room overrides for tid-%s: %s", tenantID, err)
+		return overrides, err
+	} else if len(value) == 0 {
+		return overrides, nil
+	}
+
+	err = json.Unmarshal(value, &overrides)
+	return overrides, err
+}
+
+// Set replaces the overrides of a tenant
+func (o *RoomOverrides) Set(tenantID string, overrides map[int]RoomOverride) error {
+	value, err := json.Marshal(overrides)
+	if err != nil {
+		return err
+	}
+
+	store := o.server.NewTenantStore(overridesStoreKey)
+	return store.Set(tenantID, value)
+}
+
+// Del removes all the overrides of a tenant
+func (o *RoomOverrides) Del(tenantID string) error {
+	store := o.server.NewTenantStore(overridesStoreKey)
+	return store.Del(tenantID)
+}
+
+// decision returns the decision for a room with an override, exempt rooms are never archived
+func (o RoomOverride) decision() Decision {
+	if o.Exempt {
+		return Decision{Action: ActionNever, Reason: "room override"}
+	}
+
+	return Decision{Action: ActionArchive, Threshold: o.Threshold, Reason: "room override"}
+}
+
+// sortedOverrides returns the overrides ordered by room ID
+func sortedOverrides(overrides map[int]RoomOverride) []RoomOverride {
+	sorted := make([]RoomOverride, 0, len(overrides))
+	for _, override := range overrides {
+		sorted = append(sorted, override)
+	}
+
+	sort.Sort(byRoomID(sorted))
+	return sorted
+}
+
+type byRoomID []RoomOverride
+
+func (s byRoomID) Len() int           { return len(s) }
+func (s byRoomID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byRoomID) Less(i, j int) bool { return s[i].RoomID < s[j].RoomID }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tbruyelle/hipchat-go/hipchat"
+)
+
+func TestParseThreshold(t *testing.T) {
+	tests := []struct {
+		value     string
+		threshold int
+		valid     bool
+	}{
+		{"30", 30, true},
+		{"1", 1, true},
+		{"0", 0, false},
+		{"-7", 0, false},
+		{"", 0, false},
+		{"soon", 0, false},
+	}
+
+	for _, tt := range tests {
+		threshold, err := parseThreshold(tt.value)
+		if threshold != tt.threshold || (err == nil) != tt.valid {
+			t.Error(fmt.Sprintf("parseThreshold was wrong. Value=%s Expected=%d valid %v Actual=%d %v", tt.value, tt.threshold, tt.valid, threshold, err))
+		}
+	}
+}
+
+func TestRoomOverridePrecedence(t *testing.T) {
+	start := time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC)
+
+	configuration := &TenantConfiguration{
+		Threshold: 90,
+		Policy: Policy{
+			{Name: "keep", NameGlob: "keep-*", Action: ActionNever},
+			{Name: "quick", NameGlob: "quick-*", Action: ActionArchive, Days: 1},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		topic    string
+		override RoomOverride
+		outcome  roomOutcome
+	}{
+		// The override wins over a policy rule that never archives the room
+		{name: "keep-policy", override: RoomOverride{Threshold: 5}, outcome: roomArchived},
+		// and over a topic directive
+		{name: "directive", topic: "[archive:never]", override: RoomOverride{Threshold: 5}, outcome: roomArchived},
+		// An exempt room isn't archived, whatever the policy says
+		{name: "quick-policy", override: RoomOverride{Exempt: true}, outcome: roomSkipped},
+		// A longer threshold keeps rooms that the default threshold would archive
+		{name: "patient", topic: "[archive:1d]", override: RoomOverride{Threshold: 30}, outcome: roomSkipped},
+	}
+
+	for _, tt := range tests {
+		clock := &testClock{start}
+		hipChat := newFakeHipChat(clock)
+		hipChat.addRoom(hipchat.Room{ID: 1, Name: tt.name, Topic: tt.topic}, hipchat.RoomStatistics{})
+		hipChat.setLastActive(1, start.AddDate(0, 0, -10))
+
+		job := newTestJob(clock, hipChat)
+		tt.override.RoomID = 1
+		outcome := job.processRoom(hipChat.rooms[1], configuration, map[int]RoomOverride{1: tt.override})
+		hipChat.server.Close()
+
+		if outcome != tt.outcome {
+			t.Error(fmt.Sprintf("Override didn't take precedence. Room=%s Override=%+v Expected=%v Actual=%v", tt.name, tt.override, tt.outcome, outcome))
+		}
+	}
+}
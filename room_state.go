@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"bitbucket.org/rbergman/go-hipchat-connect/store"
+	"github.com/tbruyelle/hipchat-go/hipchat"
+)
+
+const roomStatesStoreKey = "rooms"
+
+// notificationSlack is how long after one of our notifications the last active date of a room can be updated
+// because of it
+const notificationSlack = 5 * time.Minute
+
+// RoomState is what the auto archiver remembers about a room between runs
+type RoomState struct {
+	// IdleSince is when the room became idle, as measured before we sent a notification to it. For rooms whose last
+	// active date is unknown, it's the first time we saw them idle.
+	IdleSince time.Time
+	// NotifiedAt is the last time we sent a notification to the room
+	NotifiedAt time.Time
+	// WarnedAt is when we warned the room that it was going to be archived
+	WarnedAt time.Time
+	// ArchivedAt is when we archived the room
+	ArchivedAt time.Time
+	// ArchivedLastActive is the last active date of the room right after we archived it. A room whose last active
+	// date changed since then was unarchived by someone, so it's no longer the archive we made.
+	ArchivedLastActive string `json:",omitempty"`
+	// KeepUntil is when the cooldown of a room that someone unarchived after we archived it ends
+	KeepUntil time.Time
+	// GuestAccessDisabledAt is when we disabled the guest access of the room. It's kept when the rest of the state is
+	// reset, so the room keeps the guest access threshold.
+	GuestAccessDisabledAt time.Time
+}
+
+// RoomStates keeps the state of the rooms of a tenant. It's safe to use from the concurrent room processors, even if
+// the underlying store isn't.
+type RoomStates struct {
+	mutex sync.Mutex
+	store store.Store
+}
+
+// NewRoomStates returns the RoomStates of a tenant
+func (s *Server) NewRoomStates(tenantID string) *RoomStates {
+	return newRoomStates(s.NewTenantStore(roomStatesStoreKey).Sub(tenantID))
+}
+
+func newRoomStates(s store.Store) *RoomStates {
+	return &RoomStates{store: s}
+}
+
+// Get returns the state of a room, or an empty state if we don't know anything about it
+func (r *RoomStates) Get(roomID int) (*RoomState, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	state := &RoomState{}
+
+	value, err := r.store.Get(strconv.Itoa(roomID))
+	if err != nil || len(value) == 0 {
+		return state, err
+	}
+
+	err = json.NewDecoder(bytes.NewReader(value)).Decode(state)
+	return state, err
+}
+
+// Set updates the state of a room
+func (r *RoomStates) Set(roomID int, state *RoomState) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return r.store.Set(strconv.Itoa(roomID), value)
+}
+
+// Del forgets everything about a room
+func (r *RoomStates) Del(roomID int) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.store.Del(strconv.Itoa(roomID))
+}
+
+// isEmpty returns true if there is nothing to remember about the room
+func (s *RoomState) isEmpty() bool {
+	return *s == RoomState{}
+}
+
+// saveRoomState persists the state of the room, or deletes it if it's empty. It's a no-op on dry runs.
+func (j *Job) saveRoomState(roomID int, state *RoomState) {
+	if j.DryRun {
+		return
+	}
+
+	var err error
+	if state.isEmpty() {
+		err = j.States.Del(roomID)
+	} else {
+		err = j.States.Set(roomID, state)
+	}
+
+	if err != nil {
+		j.Log.Record("rid", roomID).Errorf("Couldn't save the state of the room: %v", err)
+	}
+}
+
+// resolveIdleDays takes into account the notifications we sent to the room, since they update its last active
+// date. If nobody has used the room since we last notified it, the room has been idle since before the notification.
+// Otherwise, the room was used again and the state of the room is reset. There are no stats when the activity comes
+// from the history of the room, which already ignores notifications.
+func (j *Job) resolveIdleDays(roomID int, daysSinceLastActive int, stats *hipchat.RoomStatistics, state *RoomState) int {
+	if state.NotifiedAt.IsZero() || stats == nil {
+		return daysSinceLastActive
+	}
+
+	if j.HasBeenActiveSince(roomID, stats, state.NotifiedAt.Add(notificationSlack)) {
+		j.Log.Record("rid", roomID).Infof("Room was used after we notified it, resetting its state")
+		*state = RoomState{GuestAccessDisabledAt: state.GuestAccessDisabledAt}
+		j.saveRoomState(roomID, state)
+		return daysSinceLastActive
+	}
+
+	return daysBetween(state.IdleSince, j.Clock.Now())
+}
+
+// GetDaysSinceFirstObservedIdle is used for rooms whose last active date is unknown, it returns how many days
+// have passed since we first saw the room idle
+func (j *Job) GetDaysSinceFirstObservedIdle(roomID int, state *RoomState) int {
+	deltaInDays := daysBetween(state.IdleSince, j.Clock.Now())
+	j.Log.Record("rid", roomID).Debugf("Was first observed idle %d days ago", deltaInDays)
+	return deltaInDays
+}
+
+// recordNotification remembers that we notified a room that has been idle for idleDays
+func (j *Job) recordNotification(roomID int, idleDays int, state *RoomState) {
+	now := j.Clock.Now()
+	if state.IdleSince.IsZero() {
+		state.IdleSince = now.Add(-time.Duration(idleDays) * 24 * time.Hour)
+	}
+
+	state.NotifiedAt = now
+	j.saveRoomState(roomID, state)
+}
+
+// daysBetween returns the number of full days between two dates
+func daysBetween(from time.Time, to time.Time) int {
+	return int(to.Sub(from).Hours() / 24) //assumes every day has 24 hours, not DST aware
+}
@@ -111,3 +111,64 @@ func TestShouldArchiveRoomTopic(t *testing.T) {
 		}
 	}
 }
+
+func TestTopicArchiveAfter(t *testing.T) {
+	var parseTests = []struct {
+		topic    string
+		expected time.Time
+		ok       bool
+	}{
+		{"[archive:after 2026-12-01]", time.Date(2026, 12, 01, 0, 0, 0, 0, time.UTC), true},
+		{"Launch party | [Archive:After 2026-12-01] | bring snacks", time.Date(2026, 12, 01, 0, 0, 0, 0, time.UTC), true},
+		{"archive-after: 2026-12-01", time.Date(2026, 12, 01, 0, 0, 0, 0, time.UTC), true},
+		{"Launch party | Archive-After:2026-12-01 | bring snacks", time.Date(2026, 12, 01, 0, 0, 0, 0, time.UTC), true},
+		{"[archive:after next month]", time.Time{}, false},
+		{"archive-after: next month", time.Time{}, false},
+		{"archive-after:", time.Time{}, false},
+		{"archive after 2026-12-01", time.Time{}, false},
+		{"", time.Time{}, false},
+	}
+
+	for _, tt := range parseTests {
+		directive, ok := TopicArchiveAfter(tt.topic)
+		if ok != tt.ok || !directive.On.Equal(tt.expected) {
+			t.Error(fmt.Sprintf("TopicArchiveAfter was wrong. Expected=%v/%v Actual=%v/%v Topic=%s", tt.expected, tt.ok, directive.On, ok, tt.topic))
+		}
+	}
+}
+
+func TestIsOldEnoughToArchive(t *testing.T) {
+	var ageTests = []struct {
+		daysSinceCreated int
+		minimumAgeDays   int
+		topic            string
+		now              time.Time
+		expected         bool
+	}{
+		{10, 0, "", time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC), true},
+		{10, 30, "", time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC), false},
+		{30, 30, "", time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC), true},
+		{-1, 30, "", time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC), true},
+		{100, 0, "archive-after: 2026-12-01", time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC), false},
+		{100, 0, "archive-after: 2026-12-01", time.Date(2026, 12, 01, 12, 0, 0, 0, time.UTC), false},
+		{100, 0, "archive-after: 2026-12-01", time.Date(2026, 12, 02, 0, 0, 0, 0, time.UTC), true},
+		{100, 0, "archive-after: soon", time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC), true},
+		{100, 0, "[archive:after 2026-12-01] [archive:30d]", time.Date(2026, 12, 01, 12, 0, 0, 0, time.UTC), false},
+		{100, 0, "[archive:after 2026-12-01] [archive:30d]", time.Date(2026, 12, 02, 0, 0, 0, 0, time.UTC), true},
+	}
+
+	for _, tt := range ageTests {
+
+		mockJob := Job{
+			Log:      bunyan.NewStdLogger("test", bunyan.NilSink()),
+			JobID:    "jobId",
+			TenantID: "work.TenantID",
+			Clock:    &testClock{tt.now},
+		}
+
+		oldEnough := mockJob.IsOldEnoughToArchive(1, tt.daysSinceCreated, tt.minimumAgeDays, tt.topic)
+		if oldEnough != tt.expected {
+			t.Error(fmt.Sprintf("IsOldEnoughToArchive was wrong. Expected=%v Actual=%v Created=%d days ago Topic=%s", tt.expected, oldEnough, tt.daysSinceCreated, tt.topic))
+		}
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
 	"path"
 	"strconv"
+	"strings"
 
 	"bitbucket.org/rbergman/go-hipchat-connect/web"
 )
@@ -30,7 +32,7 @@ func (s *Server) configurable(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.buildConfigTemplate(w, tenantConfiguration)
+	s.buildConfigTemplate(w, tenantConfiguration, "")
 }
 
 func (s *Server) postConfigurable(w http.ResponseWriter, r *http.Request) {
@@ -41,41 +43,292 @@ func (s *Server) postConfigurable(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	strThreshold := r.FormValue("threshold")
+	tenantConfigurations := s.NewTenantConfigurations()
+	tenantConfiguration, err := tenantConfigurations.Get(tenant.ID)
 
-	if strThreshold == "" {
-		s.Log.Debugf("postConfigurable bad values")
-		err := fmt.Errorf("Threshold't value is missing")
+	if err != nil {
+		err := fmt.Errorf("Couldn't get a configuration for %v: %s", tenant.ID, err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	threshold, err := strconv.Atoi(strThreshold)
+	var status int
+	message := ""
+	switch r.FormValue("action") {
+	case "override":
+		status, err = s.setRoomOverride(r, tenant.ID)
+	case "removeOverride":
+		status, err = s.removeRoomOverride(r, tenant.ID)
+	case "policy":
+		status, err = s.updatePolicy(r, tenantConfiguration)
+	case "schedule":
+		status, err = s.updateSchedule(r, tenantConfiguration)
+	case "preview":
+		status, err = s.startPreview(s.TaskServer, tenant.ID)
+		message = "The preview has started, reload the page in a few minutes to see which rooms would be archived."
+	case "runNow":
+		status, err = s.runNow(s.TaskServer, tenant.ID)
+		message = "The rooms will be processed in a few minutes."
+	case "restore":
+		status, err = s.startRestore(s.TaskServer, tenant.ID, strings.TrimSpace(r.FormValue("job")), strings.TrimSpace(r.FormValue("from")), strings.TrimSpace(r.FormValue("to")))
+		message = "The rooms will be unarchived in a few minutes, reload the page to see the progress."
+	default:
+		status, err = s.updateSettings(r, tenantConfiguration)
+	}
+
 	if err != nil {
-		err := fmt.Errorf("Threshold't value wasn't an integer: %s", strThreshold)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		s.Log.Debugf("postConfigurable failed: %s", err)
+		http.Error(w, err.Error(), status)
 		return
 	}
 
-	tenantConfigurations := s.NewTenantConfigurations()
-	tenantConfiguration := &TenantConfiguration{tenant.ID, threshold}
-	err = tenantConfigurations.Set(tenantConfiguration)
+	s.buildConfigTemplate(w, tenantConfiguration, message)
+}
+
+func (s *Server) saveConfiguration(tenantConfiguration *TenantConfiguration) (int, error) {
+	err := s.NewTenantConfigurations().Set(tenantConfiguration)
 
 	if err != nil {
-		s.Log.Errorf("postConfigurable failed to update threshold: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		err := fmt.Errorf("Internal Server Error")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		s.Log.Errorf("postConfigurable failed to update the configuration: %s", err)
+		return http.StatusInternalServerError, fmt.Errorf("Internal Server Error")
+	}
+
+	return http.StatusOK, nil
+}
+
+func (s *Server) updateSettings(r *http.Request, tenantConfiguration *TenantConfiguration) (int, error) {
+	threshold, err := parseThreshold(r.FormValue("threshold"))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	tenantConfiguration.Threshold = threshold
+
+	optionalDays := map[string]*int{
+		"warningDays":            &tenantConfiguration.WarningDays,
+		"publicThreshold":        &tenantConfiguration.PublicThreshold,
+		"privateThreshold":       &tenantConfiguration.PrivateThreshold,
+		"guestThreshold":         &tenantConfiguration.GuestThreshold,
+		"disableGuestAccessDays": &tenantConfiguration.DisableGuestAccessDays,
+		"deleteAfterDays":        &tenantConfiguration.DeleteAfterDays,
+		"unarchiveCooldownDays":  &tenantConfiguration.UnarchiveCooldownDays,
+		"minimumAgeDays":         &tenantConfiguration.MinimumAgeDays,
+		"concurrency":            &tenantConfiguration.Concurrency,
+		"requestsPerMinute":      &tenantConfiguration.RequestsPerMinute,
+	}
+
+	for name, days := range optionalDays {
+		err = parseOptionalDays(r.FormValue(name), days)
+		if err != nil {
+			return http.StatusBadRequest, fmt.Errorf("%s value wasn't a positive integer: %s", name, r.FormValue(name))
+		}
+	}
+
+	tenantConfiguration.DryRun = r.FormValue("dryRun") == "true"
+	tenantConfiguration.DryRunUntil = strings.TrimSpace(r.FormValue("dryRunUntil"))
+	if err = tenantConfiguration.validateDryRunUntil(); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	tenantConfiguration.DeleteEnabled = r.FormValue("deleteEnabled") == "true"
+	if tenantConfiguration.DeleteEnabled && tenantConfiguration.DeleteAfterDays < 1 {
+		return http.StatusBadRequest, fmt.Errorf("Rooms can only be deleted at least one day after archiving them")
 	}
 
-	s.buildConfigTemplate(w, tenantConfiguration)
+	if activitySource := r.FormValue("activitySource"); activitySource != "" {
+		if activitySource != ActivityFromStats && activitySource != ActivityFromHistory {
+			return http.StatusBadRequest, fmt.Errorf("Activity source must be %s or %s", ActivityFromStats, ActivityFromHistory)
+		}
+
+		tenantConfiguration.ActivitySource = activitySource
+		tenantConfiguration.IgnoredSenders = splitList(r.FormValue("ignoredSenders"))
+	}
+
+	return s.saveConfiguration(tenantConfiguration)
 }
 
-func (s *Server) buildConfigTemplate(w http.ResponseWriter, tenantConfiguration *TenantConfiguration) {
+func (s *Server) updateSchedule(r *http.Request, tenantConfiguration *TenantConfiguration) (int, error) {
+	tenantConfiguration.Schedule = strings.TrimSpace(r.FormValue("schedule"))
+	tenantConfiguration.DailyAt = strings.TrimSpace(r.FormValue("dailyAt"))
+	tenantConfiguration.Timezone = strings.TrimSpace(r.FormValue("timezone"))
+
+	_, err := tenantConfiguration.schedule(nil)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	return s.saveConfiguration(tenantConfiguration)
+}
+
+func (s *Server) updatePolicy(r *http.Request, tenantConfiguration *TenantConfiguration) (int, error) {
+	var policy Policy
+
+	strPolicy := strings.TrimSpace(r.FormValue("policy"))
+	if strPolicy != "" {
+		err := json.Unmarshal([]byte(strPolicy), &policy)
+		if err != nil {
+			return http.StatusBadRequest, fmt.Errorf("Policy isn't valid JSON: %s", err)
+		}
+	}
+
+	err := policy.Validate()
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	tenantConfiguration.Policy = policy
+	return s.saveConfiguration(tenantConfiguration)
+}
+
+func (s *Server) setRoomOverride(r *http.Request, tenantID string) (int, error) {
+	roomID, err := strconv.Atoi(r.FormValue("room"))
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("Room ID wasn't an integer: %s", r.FormValue("room"))
+	}
+
+	override := RoomOverride{RoomID: roomID}
+	if r.FormValue("threshold") == "exempt" {
+		override.Exempt = true
+	} else {
+		override.Threshold, err = parseThreshold(r.FormValue("threshold"))
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+
+	return s.updateRoomOverrides(tenantID, func(overrides map[int]RoomOverride) {
+		overrides[roomID] = override
+	})
+}
+
+func (s *Server) removeRoomOverride(r *http.Request, tenantID string) (int, error) {
+	roomID, err := strconv.Atoi(r.FormValue("room"))
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("Room ID wasn't an integer: %s", r.FormValue("room"))
+	}
+
+	return s.updateRoomOverrides(tenantID, func(overrides map[int]RoomOverride) {
+		delete(overrides, roomID)
+	})
+}
+
+func (s *Server) updateRoomOverrides(tenantID string, update func(map[int]RoomOverride)) (int, error) {
+	roomOverrides := s.NewRoomOverrides()
+	overrides, err := roomOverrides.Get(tenantID)
+	if err != nil {
+		s.Log.Errorf("postConfigurable failed to get the room overrides: %s", err)
+		return http.StatusInternalServerError, fmt.Errorf("Internal Server Error")
+	}
+
+	update(overrides)
+
+	err = roomOverrides.Set(tenantID, overrides)
+	if err != nil {
+		s.Log.Errorf("postConfigurable failed to update the room overrides: %s", err)
+		return http.StatusInternalServerError, fmt.Errorf("Internal Server Error")
+	}
+
+	return http.StatusOK, nil
+}
+
+// splitList splits a comma separated list, ignoring empty values
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// parseOptionalDays updates days with the value, if it's not empty
+func parseOptionalDays(value string, days *int) error {
+	if value == "" {
+		return nil
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		return fmt.Errorf("Invalid number of days: %s", value)
+	}
+
+	*days = parsed
+	return nil
+}
+
+func parseThreshold(strThreshold string) (int, error) {
+	if strThreshold == "" {
+		return 0, fmt.Errorf("Threshold't value is missing")
+	}
+
+	threshold, err := strconv.Atoi(strThreshold)
+	if err != nil {
+		return 0, fmt.Errorf("Threshold't value wasn't an integer: %s", strThreshold)
+	}
+
+	// A threshold of 0 would archive every room, even the ones used today
+	if threshold < 1 {
+		return 0, fmt.Errorf("Threshold't value must be greater than 0: %s", strThreshold)
+	}
+
+	return threshold, nil
+}
+
+func (s *Server) buildConfigTemplate(w http.ResponseWriter, tenantConfiguration *TenantConfiguration, message string) {
 	lp := path.Join("./static", "configurable.hbs")
-	vals := map[string]string{
-		"Threshold": strconv.Itoa(tenantConfiguration.Threshold),
+	policy := ""
+	if len(tenantConfiguration.Policy) > 0 {
+		b, _ := json.MarshalIndent(tenantConfiguration.Policy, "", "  ")
+		policy = string(b)
+	}
+
+	overrides, err := s.NewRoomOverrides().Get(tenantConfiguration.ID)
+	if err != nil {
+		s.Log.Errorf("Couldn't get the room overrides for tid-%s: %v", tenantConfiguration.ID, err)
+	}
+
+	preview, previewRunning := s.lastPreview(s.TaskServer, tenantConfiguration.ID)
+
+	dryRunReport, err := s.NewDryRunReports().Get(tenantConfiguration.ID)
+	if err != nil {
+		s.Log.Errorf("Couldn't get the dry run report for tid-%s: %v", tenantConfiguration.ID, err)
+	}
+
+	restore, err := s.NewRestores().Get(tenantConfiguration.ID)
+	if err != nil {
+		s.Log.Errorf("Couldn't get the restore for tid-%s: %v", tenantConfiguration.ID, err)
+	}
+
+	vals := map[string]interface{}{
+		"Threshold":              strconv.Itoa(tenantConfiguration.Threshold),
+		"WarningDays":            strconv.Itoa(tenantConfiguration.WarningDays),
+		"PublicThreshold":        strconv.Itoa(tenantConfiguration.PublicThreshold),
+		"PrivateThreshold":       strconv.Itoa(tenantConfiguration.PrivateThreshold),
+		"GuestThreshold":         strconv.Itoa(tenantConfiguration.GuestThreshold),
+		"DisableGuestAccessDays": strconv.Itoa(tenantConfiguration.DisableGuestAccessDays),
+		"DeleteEnabled":          tenantConfiguration.DeleteEnabled,
+		"DeleteAfterDays":        strconv.Itoa(tenantConfiguration.DeleteAfterDays),
+		"UnarchiveCooldownDays":  strconv.Itoa(tenantConfiguration.unarchiveCooldownDays()),
+		"MinimumAgeDays":         strconv.Itoa(tenantConfiguration.MinimumAgeDays),
+		"Schedule":               tenantConfiguration.Schedule,
+		"DailyAt":                tenantConfiguration.DailyAt,
+		"Timezone":               tenantConfiguration.Timezone,
+		"Concurrency":            strconv.Itoa(tenantConfiguration.Concurrency),
+		"RequestsPerMinute":      strconv.Itoa(tenantConfiguration.RequestsPerMinute),
+		"FromHistory":            tenantConfiguration.ActivitySource == ActivityFromHistory,
+		"IgnoredSenders":         strings.Join(tenantConfiguration.IgnoredSenders, ", "),
+		"Policy":                 policy,
+		"Overrides":              sortedOverrides(overrides),
+		"Message":                message,
+		"Preview":                preview,
+		"PreviewRunning":         previewRunning,
+		"DryRun":                 tenantConfiguration.DryRun,
+		"DryRunUntil":            tenantConfiguration.DryRunUntil,
+		"DryRunReport":           dryRunReport,
+		"History":                s.recentHistory(tenantConfiguration.ID),
+		"Restore":                restore,
 	}
 
 	tmpl, err := template.ParseFiles(lp)
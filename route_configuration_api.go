@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"bitbucket.org/rbergman/go-hipchat-connect/web"
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/context"
+)
+
+// configurationErrors is the response to a configuration that wasn't saved
+type configurationErrors struct {
+	Errors ValidationErrors
+}
+
+// MountConfigurationAPI mounts the configuration of the tenant as JSON, authenticated with its JWT:
+// * GET /api/v1/configuration   -> the configuration of the tenant
+// * PUT /api/v1/configuration   -> updates the configuration, the fields that are left out keep their values
+func (s *Server) MountConfigurationAPI(path string) {
+	n := negroni.New(
+		web.NewAuthenticate(&s.Server),
+		negroni.Wrap(context.ClearHandler(http.HandlerFunc(s.configurationAPI))),
+	)
+	s.Router.Get(path, n)
+	s.Router.Put(path, n)
+}
+
+func (s *Server) configurationAPI(w http.ResponseWriter, r *http.Request) {
+	tenant, err := web.GetTenant(r)
+	if err != nil {
+		writeConfigurationErrors(w, http.StatusInternalServerError, FieldError{Message: "Internal Server Error: tenant wasn't in the context"})
+		return
+	}
+
+	tenantConfigurations := s.NewTenantConfigurations()
+	tenantConfiguration, err := tenantConfigurations.Get(tenant.ID)
+	if err != nil {
+		s.Log.Errorf("Couldn't get a configuration for tid-%s: %s", tenant.ID, err)
+		writeConfigurationErrors(w, http.StatusInternalServerError, FieldError{Message: "Couldn't get the configuration"})
+		return
+	}
+
+	if r.Method == "PUT" {
+		updated, status, errs := updateConfiguration(tenantConfiguration, r.Body)
+		if errs != nil {
+			writeConfigurationErrors(w, status, errs...)
+			return
+		}
+
+		if err := tenantConfigurations.Set(updated); err != nil {
+			s.Log.Errorf("Couldn't update the configuration of tid-%s: %s", tenant.ID, err)
+			writeConfigurationErrors(w, http.StatusInternalServerError, FieldError{Message: "Couldn't save the configuration"})
+			return
+		}
+
+		tenantConfiguration = updated
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tenantConfiguration)
+}
+
+// updateConfiguration returns the configuration with the fields of the body replaced, if they are all valid.
+// Otherwise it returns the status of the response and why the body wasn't valid.
+func updateConfiguration(current *TenantConfiguration, body io.Reader) (*TenantConfiguration, int, ValidationErrors) {
+	value, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, http.StatusBadRequest, ValidationErrors{{Message: fmt.Sprintf("Couldn't read the configuration: %s", err)}}
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(value, &fields); err != nil {
+		return nil, http.StatusBadRequest, ValidationErrors{{Message: fmt.Sprintf("Configuration isn't valid JSON: %s", err)}}
+	}
+
+	// encoding/json skips the keys that aren't fields, so a misspelled one would look like it was saved
+	if errs := unknownFields(fields); errs != nil {
+		return nil, http.StatusUnprocessableEntity, errs
+	}
+
+	// The lists are decoded from scratch, since decoding over the current ones would keep the fields of the rules
+	// that the body leaves out. They keep their values only when the body leaves them out altogether.
+	updated := *current
+	updated.Policy = nil
+	updated.IgnoredSenders = nil
+	if err := json.Unmarshal(value, &updated); err != nil {
+		return nil, http.StatusBadRequest, ValidationErrors{{Message: fmt.Sprintf("Configuration isn't valid JSON: %s", err)}}
+	}
+
+	if !hasField(fields, "Policy") {
+		updated.Policy = current.Policy
+	}
+	if !hasField(fields, "IgnoredSenders") {
+		updated.IgnoredSenders = current.IgnoredSenders
+	}
+
+	if updated.ID != current.ID {
+		return nil, http.StatusUnprocessableEntity, ValidationErrors{{Field: "ID", Message: "Can't be changed"}}
+	}
+
+	if errs := updated.Validate(); errs != nil {
+		return nil, http.StatusUnprocessableEntity, errs
+	}
+
+	return &updated, http.StatusOK, nil
+}
+
+// hasField returns true if the field is in the body. The keys are matched like encoding/json does, ignoring the case.
+func hasField(fields map[string]json.RawMessage, name string) bool {
+	for key := range fields {
+		if strings.EqualFold(key, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// unknownFields returns an error for every key of the body that isn't a field of the configuration
+func unknownFields(fields map[string]json.RawMessage) ValidationErrors {
+	var keys []string
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	configurationType := reflect.TypeOf(TenantConfiguration{})
+	var errs ValidationErrors
+	for _, key := range keys {
+		known := false
+		for i := 0; i < configurationType.NumField(); i++ {
+			if strings.EqualFold(key, configurationType.Field(i).Name) {
+				known = true
+				break
+			}
+		}
+
+		if !known {
+			errs = append(errs, FieldError{Field: key, Message: "Unknown field"})
+		}
+	}
+
+	return errs
+}
+
+func writeConfigurationErrors(w http.ResponseWriter, status int, errs ...FieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(configurationErrors{Errors: errs})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"bitbucket.org/rbergman/go-hipchat-connect/tenant"
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestConfigurationAPI(t *testing.T) {
+	s := newFakeRedisServer(newFakeRedis(&testClock{time.Now()}))
+	s.MountConfigurationAPI("/api/v1/configuration")
+
+	if err := s.NewTenants().Set(&tenant.Tenant{ID: "tenant-1", Secret: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	current := &TenantConfiguration{ID: "tenant-1", Threshold: 90, WarningDays: 7, Policy: Policy{{Name: "oncall", NameGlob: "oncall-*", Action: ActionNever}}}
+	if err := s.NewTenantConfigurations().Set(current); err != nil {
+		t.Fatal(err)
+	}
+
+	token := jwt.New(jwt.SigningMethodHS256)
+	token.Claims["iss"] = "tenant-1"
+	signed, err := token.SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(method string, body io.Reader) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/api/v1/configuration", body)
+		req.Header.Set("Authorization", "JWT "+signed)
+		w := httptest.NewRecorder()
+		s.Router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("GET", nil)
+	configuration := &TenantConfiguration{}
+	if err := json.NewDecoder(w.Body).Decode(configuration); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("GET failed. Expected=%d Actual=%d %v", http.StatusOK, w.Code, err)
+	}
+	if configuration.Threshold != 90 || len(configuration.Policy) != 1 {
+		t.Errorf("GET returned the wrong configuration. Actual=%+v", configuration)
+	}
+
+	// the rule replaces the current one, instead of keeping the NameGlob it leaves out
+	w = request("PUT", strings.NewReader(`{"WarningDays": 3, "Policy": [{"Name": "oncall", "Action": "archive", "Days": 30}]}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT failed. Expected=%d Actual=%d %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	saved, err := s.NewTenantConfigurations().Get("tenant-1")
+	expected := Policy{{Name: "oncall", Action: ActionArchive, Days: 30}}
+	if err != nil || saved.Threshold != 90 || saved.WarningDays != 3 || fmt.Sprint(saved.Policy) != fmt.Sprint(expected) {
+		t.Errorf("PUT saved the wrong configuration. Expected=90/3 %v Actual=%+v Error=%v", expected, saved, err)
+	}
+
+	w = request("PUT", strings.NewReader(`{"Threshold": 0}`))
+	errs := configurationErrors{}
+	if err := json.NewDecoder(w.Body).Decode(&errs); w.Code != http.StatusUnprocessableEntity || err != nil || len(errs.Errors) != 1 || errs.Errors[0].Field != "Threshold" {
+		t.Errorf("PUT of an invalid configuration was wrong. Expected=%d Threshold Actual=%d %+v %v", http.StatusUnprocessableEntity, w.Code, errs, err)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("The errors weren't JSON. Actual=%s", contentType)
+	}
+
+	w = request("PUT", strings.NewReader(`{"Threshhold": 30}`))
+	errs = configurationErrors{}
+	if err := json.NewDecoder(w.Body).Decode(&errs); w.Code != http.StatusUnprocessableEntity || err != nil || len(errs.Errors) != 1 || errs.Errors[0].Field != "Threshhold" {
+		t.Errorf("PUT of an unknown field was wrong. Expected=%d Threshhold Actual=%d %+v %v", http.StatusUnprocessableEntity, w.Code, errs, err)
+	}
+
+	for _, method := range []string{"POST", "DELETE"} {
+		if w := request(method, strings.NewReader(`{"Threshold": 30}`)); w.Code != http.StatusNotFound {
+			t.Errorf("%s wasn't routed away. Expected=%d Actual=%d", method, http.StatusNotFound, w.Code)
+		}
+	}
+
+	if saved, _ := s.NewTenantConfigurations().Get("tenant-1"); saved.Threshold != 90 {
+		t.Errorf("The configuration was changed by a rejected request. Actual=%+v", saved)
+	}
+
+	req, _ := http.NewRequest("GET", "/api/v1/configuration", nil)
+	w = httptest.NewRecorder()
+	s.Router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("GET without a JWT was wrong. Expected=%d Actual=%d", http.StatusUnauthorized, w.Code)
+	}
+}
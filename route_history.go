@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"bitbucket.org/rbergman/go-hipchat-connect/web"
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/context"
+)
+
+// historyJobsWithEntries is how many of the latest jobs are shown with their entries on the configuration page
+const historyJobsWithEntries = 5
+
+// historyJob is a job of the history, with what it did to the rooms
+type historyJob struct {
+	JobRecord
+	Entries []AuditEntry `json:",omitempty"`
+}
+
+// MountHistory mounts the history of the tenant, authenticated with its JWT:
+// * GET /history            -> the jobs of the tenant, the newest first
+// * GET /history?job=<id>   -> the job, with what it did to the rooms
+func (s *Server) MountHistory(path string) {
+	n := negroni.New(
+		web.NewAuthenticate(&s.Server),
+		negroni.Wrap(context.ClearHandler(http.HandlerFunc(s.history))),
+	)
+	s.Router.Get(path, n)
+}
+
+func (s *Server) history(w http.ResponseWriter, r *http.Request) {
+	tenant, err := web.GetTenant(r)
+	if err != nil {
+		err := fmt.Errorf("Internal Server Error: tenant wasn't in the context")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jobHistory := s.NewJobHistory()
+	jobs, err := jobHistory.Jobs(tenant.ID, time.Now())
+	if err != nil {
+		s.Log.Errorf("Couldn't get the history of tid-%s: %s", tenant.ID, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	var response interface{} = jobs
+	if jobID := r.URL.Query().Get("job"); jobID != "" {
+		job, err := findJob(jobHistory, tenant.ID, jobs, jobID)
+		if err != nil {
+			s.Log.Errorf("Couldn't get jid-%s of tid-%s: %s", jobID, tenant.ID, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		} else if job == nil {
+			http.Error(w, fmt.Sprintf("Job %s not found", jobID), http.StatusNotFound)
+			return
+		}
+
+		response = job
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// findJob returns the job of the history with its entries, or nil if it's not there
+func findJob(jobHistory *JobHistory, tenantID string, jobs []JobRecord, jobID string) (*historyJob, error) {
+	for _, job := range jobs {
+		if job.JobID != jobID {
+			continue
+		}
+
+		entries, err := jobHistory.Entries(tenantID, jobID)
+		if err != nil {
+			return nil, err
+		}
+
+		return &historyJob{JobRecord: job, Entries: entries}, nil
+	}
+
+	return nil, nil
+}
+
+// recentHistory returns the jobs of the tenant for the configuration page. Only the latest ones have their entries.
+func (s *Server) recentHistory(tenantID string) []historyJob {
+	jobHistory := s.NewJobHistory()
+	jobs, err := jobHistory.Jobs(tenantID, time.Now())
+	if err != nil {
+		s.Log.Errorf("Couldn't get the history of tid-%s: %s", tenantID, err)
+		return nil
+	}
+
+	history := make([]historyJob, len(jobs))
+	for i, job := range jobs {
+		history[i].JobRecord = job
+		if i >= historyJobsWithEntries {
+			continue
+		}
+
+		history[i].Entries, err = jobHistory.Entries(tenantID, job.JobID)
+		if err != nil {
+			s.Log.Errorf("Couldn't get the entries of jid-%s of tid-%s: %s", job.JobID, tenantID, err)
+		}
+	}
+
+	return history
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+
+	"bitbucket.org/rbergman/go-hipchat-connect/model"
+	"github.com/go-zoo/bone"
+)
+
+// MountInstallable mounts the install and uninstall routes of web.Server, keeping the tenant index up to date:
+// * POST   /installable           -> s.handleInstall
+// * DELETE /installable/:tenantID -> s.handleUninstall
+func (s *Server) MountInstallable(path string) {
+	s.Router.PostFunc(path, s.handleInstall)
+	s.Router.DeleteFunc(path+"/:tenantID", s.handleUninstall)
+}
+
+// handleInstall registers the tenant with web.Server.HandleInstall, and adds it to the tenant index if it succeeded
+func (s *Server) handleInstall(w http.ResponseWriter, r *http.Request) {
+	var tenantID string
+	if r.Body != nil {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if installable, err := model.DecodeInstallable(bytes.NewReader(body)); err == nil {
+			tenantID = installable.OAuthID
+		}
+	}
+
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	s.HandleInstall(recorder, r)
+	if recorder.status != http.StatusOK || tenantID == "" {
+		return
+	}
+
+	if err := s.NewTenantIndex().Add(tenantID); err != nil {
+		s.Log.Errorf("Couldn't add tid-%s to the tenant index: %v", tenantID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.Log.Infof("Added tid-%s to the tenant index", tenantID)
+}
+
+// handleUninstall unregisters the tenant with web.Server.HandleUninstall, and removes it from the tenant index along
+// with its room overrides
+func (s *Server) handleUninstall(w http.ResponseWriter, r *http.Request) {
+	tenantID := bone.GetValue(r, "tenantID")
+
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	s.HandleUninstall(recorder, r)
+	if recorder.status != http.StatusOK {
+		return
+	}
+
+	if err := s.NewTenantIndex().Remove(tenantID); err != nil {
+		s.Log.Errorf("Couldn't remove tid-%s from the tenant index: %v", tenantID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.Log.Infof("Removed tid-%s from the tenant index", tenantID)
+
+	if err := s.NewRoomOverrides().Del(tenantID); err != nil {
+		s.Log.Errorf("Couldn't remove the room overrides of tid-%s: %v", tenantID, err)
+	}
+}
+
+// statusRecorder remembers the status code written to the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newHipChatInstaller serves the capabilities descriptor and the token endpoint that the install handler calls
+func newHipChatInstaller() *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/capabilities":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"name": "HipChat",
+				"links": map[string]string{
+					"self":     server.URL + "/capabilities",
+					"api":      server.URL,
+					"homepage": server.URL,
+				},
+				"capabilities": map[string]interface{}{
+					"oauth2Provider": map[string]string{"tokenUrl": server.URL + "/oauth/token"},
+				},
+			})
+		case "/oauth/token":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token": "token",
+				"group_name":   "Group",
+				"expires_in":   3600,
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	return server
+}
+
+func TestInstallAndUninstall(t *testing.T) {
+	hipChat := newHipChatInstaller()
+	defer hipChat.Close()
+
+	r := newFakeRedis(&testClock{time.Now()})
+	s := newFakeRedisServer(r)
+	s.MountInstallable("/installable")
+
+	body := fmt.Sprintf(`{"capabilitiesUrl": "%s/capabilities", "oauthId": "tenant-1", "oauthSecret": "secret", "groupId": 1}`, hipChat.URL)
+	req, _ := http.NewRequest("POST", "/installable", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.Router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Install failed. Expected=%d Actual=%d %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	if !r.sets["hipchat:tenant-index"]["tenant-1"] {
+		t.Error("Install didn't add the tenant to the index")
+	}
+
+	if _, err := s.NewTenants().Get("tenant-1"); err != nil {
+		t.Errorf("Install didn't save the tenant: %v", err)
+	}
+
+	if err := s.NewRoomOverrides().Set("tenant-1", map[int]RoomOverride{1: {RoomID: 1, Exempt: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/installable/tenant-1", nil)
+	w = httptest.NewRecorder()
+	s.Router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Uninstall failed. Expected=%d Actual=%d %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	if r.sets["hipchat:tenant-index"]["tenant-1"] {
+		t.Error("Uninstall didn't remove the tenant from the index")
+	}
+
+	if overrides, err := s.NewRoomOverrides().Get("tenant-1"); err != nil || len(overrides) != 0 {
+		t.Errorf("Uninstall didn't remove the room overrides. Actual=%v %v", overrides, err)
+	}
+}
+
+func TestFailedInstallIsNotIndexed(t *testing.T) {
+	r := newFakeRedis(&testClock{time.Now()})
+	s := newFakeRedisServer(r)
+	s.MountInstallable("/installable")
+
+	req, _ := http.NewRequest("POST", "/installable", strings.NewReader(`{"oauthId": "tenant-1"}`))
+	w := httptest.NewRecorder()
+	s.Router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Install of a form was wrong. Expected=%d Actual=%d", http.StatusUnsupportedMediaType, w.Code)
+	}
+
+	if r.sets["hipchat:tenant-index"]["tenant-1"] {
+		t.Error("A failed install added the tenant to the index")
+	}
+}
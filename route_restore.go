@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"bitbucket.org/rbergman/go-hipchat-connect/web"
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/context"
+)
+
+// MountRestore mounts the restore of the archived rooms of the tenant, authenticated with its JWT:
+// * GET /restore                          -> the progress of the latest restore
+// * POST /restore job=<id>                -> unarchives the rooms archived by the job
+// * POST /restore from=<time>&to=<time>   -> unarchives the rooms archived during the time range
+func (s *Server) MountRestore(path string) {
+	n := negroni.New(
+		web.NewAuthenticate(&s.Server),
+		negroni.Wrap(context.ClearHandler(http.HandlerFunc(s.restore))),
+	)
+	s.Router.Get(path, n)
+	s.Router.Post(path, n)
+}
+
+func (s *Server) restore(w http.ResponseWriter, r *http.Request) {
+	tenant, err := web.GetTenant(r)
+	if err != nil {
+		err := fmt.Errorf("Internal Server Error: tenant wasn't in the context")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if r.Method == "POST" {
+		status, err = s.startRestore(s.TaskServer, tenant.ID, strings.TrimSpace(r.FormValue("job")), strings.TrimSpace(r.FormValue("from")), strings.TrimSpace(r.FormValue("to")))
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		status = http.StatusAccepted
+	}
+
+	progress, err := s.NewRestores().Get(tenant.ID)
+	if err != nil {
+		s.Log.Errorf("Couldn't get the restore of tid-%s: %s", tenant.ID, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	} else if progress == nil {
+		http.Error(w, "No rooms were restored", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(progress)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"bitbucket.org/rbergman/go-hipchat-connect/store"
+	"github.com/robfig/cron"
+)
+
+const (
+	lastRunsStoreKey = "schedules"
+	dailyAtFormat    = "15:04"
+	// scheduleSlack lets a tenant be enqueued by a tick that happens slightly before its next run is due
+	scheduleSlack = 5 * time.Second
+)
+
+// locationSchedule evaluates a schedule in the timezone of the tenant, since cron schedules use the location of the
+// time they are given
+type locationSchedule struct {
+	schedule cron.Schedule
+	location *time.Location
+}
+
+func (s locationSchedule) Next(t time.Time) time.Time {
+	return s.schedule.Next(t.In(s.location))
+}
+
+// schedule returns when the rooms of the tenant should be processed. Schedule is a standard cron expression, and
+// DailyAt is a HH:MM time. Both are evaluated in Timezone, which is UTC when it's empty. It returns defaultSchedule if
+// the tenant doesn't have a schedule of its own.
+func (t *TenantConfiguration) schedule(defaultSchedule cron.Schedule) (cron.Schedule, error) {
+	if t.Schedule == "" && t.DailyAt == "" {
+		return defaultSchedule, nil
+	}
+
+	if t.Schedule != "" && t.DailyAt != "" {
+		return nil, fmt.Errorf("Use either a cron expression or a daily time, not both")
+	}
+
+	location, err := time.LoadLocation(t.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("Unknown timezone '%s'", t.Timezone)
+	}
+
+	spec := t.Schedule
+	if t.DailyAt != "" {
+		dailyAt, err := time.Parse(dailyAtFormat, t.DailyAt)
+		if err != nil {
+			return nil, fmt.Errorf("Daily time '%s' is not HH:MM", t.DailyAt)
+		}
+		spec = fmt.Sprintf("%d %d * * *", dailyAt.Minute(), dailyAt.Hour())
+	}
+
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cron expression '%s': %v", spec, err)
+	}
+
+	return locationSchedule{schedule: schedule, location: location}, nil
+}
+
+// isDue returns true if the schedule had a run between lastRun and now. A nil schedule is always due.
+func isDue(schedule cron.Schedule, lastRun time.Time, now time.Time) bool {
+	if schedule == nil {
+		return true
+	}
+
+	next := schedule.Next(lastRun)
+	return !next.IsZero() && !next.After(now.Add(scheduleSlack))
+}
+
+// LastRuns remembers when the rooms of every tenant were last scheduled to be processed
+type LastRuns struct {
+	store store.Store
+}
+
+func (s *Server) NewLastRuns() *LastRuns {
+	return &LastRuns{store: s.NewTenantStore(lastRunsStoreKey)}
+}
+
+// Get returns when the tenant was last scheduled, or the zero time if it never was
+func (l *LastRuns) Get(tenantID string) (time.Time, error) {
+	value, err := l.store.Get(tenantID)
+	if err != nil || len(value) == 0 {
+		return time.Time{}, err
+	}
+
+	return time.Parse(time.RFC3339, string(value))
+}
+
+// Set records that the tenant was scheduled at lastRun
+func (l *LastRuns) Set(tenantID string, lastRun time.Time) error {
+	return l.store.Set(tenantID, []byte(lastRun.UTC().Format(time.RFC3339)))
+}
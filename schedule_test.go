@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+func TestTenantSchedule(t *testing.T) {
+	var scheduleTests = []struct {
+		configuration TenantConfiguration
+		from          time.Time
+		next          time.Time
+		valid         bool
+	}{
+		{TenantConfiguration{DailyAt: "02:30"}, time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC), time.Date(2016, 06, 02, 2, 30, 0, 0, time.UTC), true},
+		{TenantConfiguration{DailyAt: "02:30", Timezone: "Australia/Sydney"}, time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC), time.Date(2016, 06, 01, 16, 30, 0, 0, time.UTC), true},
+		{TenantConfiguration{Schedule: "0 2 * * 1-5"}, time.Date(2016, 06, 03, 10, 0, 0, 0, time.UTC), time.Date(2016, 06, 06, 2, 0, 0, 0, time.UTC), true},
+		{TenantConfiguration{Schedule: "0 2 * * *", DailyAt: "02:00"}, time.Time{}, time.Time{}, false},
+		{TenantConfiguration{DailyAt: "2pm"}, time.Time{}, time.Time{}, false},
+		{TenantConfiguration{DailyAt: "02:00", Timezone: "Mars/Olympus"}, time.Time{}, time.Time{}, false},
+		{TenantConfiguration{Schedule: "every day"}, time.Time{}, time.Time{}, false},
+	}
+
+	for _, tt := range scheduleTests {
+		schedule, err := tt.configuration.schedule(nil)
+		if (err == nil) != tt.valid {
+			t.Error(fmt.Sprintf("schedule was wrong. Expected valid=%v Actual=%v Configuration=%+v", tt.valid, err, tt.configuration))
+			continue
+		}
+
+		if tt.valid && !schedule.Next(tt.from).Equal(tt.next) {
+			t.Error(fmt.Sprintf("Next run was wrong. Expected=%s Actual=%s Configuration=%+v", tt.next, schedule.Next(tt.from), tt.configuration))
+		}
+	}
+}
+
+func TestIsDue(t *testing.T) {
+	daily, _ := (&TenantConfiguration{DailyAt: "02:30"}).schedule(nil)
+	now := time.Date(2016, 06, 02, 2, 31, 0, 0, time.UTC)
+
+	var dueTests = []struct {
+		schedule cron.Schedule
+		lastRun  time.Time
+		due      bool
+	}{
+		{nil, now, true},
+		{daily, time.Date(2016, 06, 01, 2, 30, 0, 0, time.UTC), true},
+		{daily, time.Date(2016, 06, 02, 2, 30, 0, 0, time.UTC), false},
+		{daily, now.Add(-2 * time.Minute), true},
+		{daily, now.Add(-30 * time.Second), false},
+		{cron.Every(time.Hour), now.Add(-time.Hour), true},
+		{cron.Every(time.Hour), now.Add(-time.Hour + time.Second), true},
+		{cron.Every(time.Hour), now.Add(-time.Minute), false},
+	}
+
+	for _, tt := range dueTests {
+		due := isDue(tt.schedule, tt.lastRun, now)
+		if due != tt.due {
+			t.Error(fmt.Sprintf("isDue was wrong. Expected=%v Actual=%v LastRun=%s", tt.due, due, tt.lastRun))
+		}
+	}
+}
+
+func TestDispatchDueTenants(t *testing.T) {
+	start := time.Date(2016, 06, 02, 0, 0, 0, 0, time.UTC)
+	s := newFakeRedisServer(newFakeRedis(&testClock{start}))
+
+	s.NewTenantIndex().Add("default")
+	s.NewTenantIndex().Add("daily")
+	s.NewTenantConfigurations().Set(&TenantConfiguration{ID: "daily", Threshold: 90, DailyAt: "02:30"})
+
+	election := s.NewLeaderElection(time.Hour)
+	defer election.Resign()
+	if !election.IsLeader() {
+		t.Fatal("The scheduler didn't become the leader")
+	}
+
+	// the tenant on the default schedule never ran, so it's due on the first tick and every hour after it
+	enqueued := map[string][]string{}
+	for i := 0; i < 180; i++ {
+		now := start.Add(time.Duration(i) * time.Minute)
+		s.dispatchTenants(election, time.Minute, cron.Every(time.Hour), now, func(tenantID string) error {
+			enqueued[tenantID] = append(enqueued[tenantID], now.Format("15:04"))
+			return nil
+		})
+	}
+
+	if fmt.Sprint(enqueued["default"]) != "[00:00 01:00 02:00]" || fmt.Sprint(enqueued["daily"]) != "[02:30]" {
+		t.Error(fmt.Sprintf("The wrong tenants were due. Expected=[00:00 01:00 02:00] [02:30] Actual=%v %v", enqueued["default"], enqueued["daily"]))
+	}
+}
@@ -1,41 +1,101 @@
 package main
 
 import (
-	"fmt"
 	"os"
 	"os/signal"
 	"sync"
+	"time"
 
 	"bitbucket.org/rbergman/go-hipchat-connect/store"
 	"bitbucket.org/rbergman/go-hipchat-connect/util"
+	machinery "github.com/RichardKnop/machinery/v1"
+	"github.com/RichardKnop/machinery/v1/backends"
 	"github.com/RichardKnop/machinery/v1/signatures"
-	"github.com/garyburd/redigo/redis"
 	"github.com/robfig/cron"
 )
 
-// StartScheduler schedules one job per tenant registered
+// defaultSchedulerTick is how often the scheduler looks for tenants that are due when SCHEDULER_TICK is not set. It's
+// the precision of the schedules of the tenants.
+const defaultSchedulerTick = "1m"
+
+// defaultSchedulerDuration is how often the tenants without a schedule of their own run when SCHEDULER_TICK is set
+// without SCHEDULER_DURATION
+const defaultSchedulerDuration = "24h"
+
+// StartScheduler schedules one job per tenant registered. The scheduler ticks every SCHEDULER_TICK, a minute by
+// default, and enqueues the tenants whose schedule is due. Tenants without a schedule of their own run every
+// SCHEDULER_DURATION, daily by default. When neither is set, every tenant is enqueued once. Any number of schedulers
+// can run, but only the one that holds the leader lease, renewed every third of SCHEDULER_LEASE_TTL, enqueues tenants.
 func StartScheduler() {
 	b := NewBackendServer("hiparchiver.scheduler")
 
 	b.Log.Infof("Starting the scheduler")
 	durationStr := util.Env.GetString("SCHEDULER_DURATION")
+	tickStr := util.Env.GetString("SCHEDULER_TICK")
+	if tickStr == "" && durationStr != "" {
+		tickStr = defaultSchedulerTick
+	} else if tickStr != "" && durationStr == "" {
+		durationStr = defaultSchedulerDuration
+	}
+
+	var defaultSchedule cron.Schedule
+	if durationStr != "" {
+		duration, err := time.ParseDuration(durationStr)
+		if err != nil {
+			b.Log.Fatalf("Invalid SCHEDULER_DURATION: %v", err)
+		}
+		defaultSchedule = cron.Every(duration)
+	}
+
+	leaseTTL, err := time.ParseDuration(util.Env.GetStringOr("SCHEDULER_LEASE_TTL", "30s"))
+	if err != nil {
+		b.Log.Fatalf("Invalid SCHEDULER_LEASE_TTL: %v", err)
+	}
 
-	if durationStr == "" {
-		b.scheduleTasks()
+	election := b.NewLeaderElection(leaseTTL)
+
+	if tickStr == "" {
+		if election.IsLeader() {
+			b.scheduleTasks(election, NewTaskServer(), 0, defaultSchedule)
+		} else {
+			b.Log.Infof("Not the leader, nothing to schedule")
+		}
+		election.Resign()
 	} else {
+		tick, err := time.ParseDuration(tickStr)
+		if err != nil {
+			b.Log.Fatalf("Invalid SCHEDULER_TICK: %v", err)
+		}
+
+		taskServer := NewTaskServer()
+		stop := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			election.Run(stop)
+			close(stopped)
+		}()
+
 		var wg sync.WaitGroup
 		wg.Add(1)
 		interrupt := make(chan os.Signal, 1)
 		signal.Notify(interrupt, os.Interrupt)
 		c := cron.New()
 		defer c.Stop()
-		c.AddFunc("@every "+durationStr, func() { b.scheduleTasks() })
-		b.Log.Infof("Adding task to local scheduler, to run every %s", durationStr)
+		c.AddFunc("@every "+tickStr, func() {
+			if !election.IsLeader() {
+				b.Log.Debugf("Not the leader, skipping the tick")
+				return
+			}
+			b.scheduleTasks(election, taskServer, tick, defaultSchedule)
+		})
+		b.Log.Infof("Adding task to local scheduler, to run every %s", tickStr)
 		c.Start()
 
 		go func() {
 			b.Log.Infof("Running local scheduler, press CTRL+C to terminate")
 			<-interrupt
+			close(stop)
+			<-stopped
 			wg.Done()
 		}()
 
@@ -44,58 +104,172 @@ func StartScheduler() {
 	}
 }
 
-func (s *Server) scheduleTasks() {
+// scheduleTasks enqueues the tenants that are due, for as long as the scheduler is the leader, and logs the summaries
+// of the jobs it enqueued that completed since. A tick of 0 means that the scheduler runs only once, so every tenant is
+// enqueued.
+func (s *Server) scheduleTasks(election *LeaderElection, taskServer *machinery.Server, tick time.Duration, defaultSchedule cron.Schedule) {
 	s.Log.Infof("start autoArchive")
-
-	taskServer := NewTaskServer()
+	defer s.logCompletedJobs(taskServer, time.Now())
 
 	tenant := util.Env.GetString("TENANT")
-	var keys []string
-	if tenant == "" {
-		keys = s.getAllTenants()
-	} else {
-		keys = s.getTenant(tenant)
-	}
-
-	for _, key := range keys {
-		tenantID := key[len("hipchat:tenants:"):]
-		s.Log.Infof("Start archiving tid-%s", tenantID)
-		task := signatures.TaskSignature{
-			Name: "autoArchive",
-			Args: []signatures.TaskArg{
-				signatures.TaskArg{
-					Type:  "string",
-					Value: tenantID,
-				},
-			},
+	if tenant != "" {
+		if _, err := s.NewTenants().Get(tenant); err != nil {
+			s.Log.Errorf("tid-%s is not installed, not scheduling it: %s", tenant, err)
+			return
 		}
 
-		_, err := taskServer.SendTask(&task)
-		if err != nil {
-			s.Log.Errorf("Failed to schedule task for tid-%s: %s", tenantID, err)
-		}
+		s.enqueueTenant(taskServer, tenant)
+		return
 	}
-}
 
-func (s *Server) getAllTenants() []string {
-	return s.getKeys("*")
+	s.dispatchTenants(election, tick, defaultSchedule, time.Now(), func(tenantID string) error {
+		return s.enqueueTenant(taskServer, tenantID)
+	})
 }
 
-func (s *Server) getTenant(tenantID string) []string {
-	return s.getKeys(tenantID)
+// enqueueTenant enqueues the autoArchive task of the tenant, and remembers it so the summary of its job is logged once
+// it completes
+func (s *Server) enqueueTenant(taskServer *machinery.Server, tenantID string) error {
+	result, err := s.scheduleTask(taskServer, tenantID)
+	if err != nil {
+		return err
+	}
+
+	job := pendingJob{TaskUUID: result.Signature.UUID, TenantID: tenantID, EnqueuedAt: time.Now()}
+	if err := s.NewPendingJobs().Add(job); err != nil {
+		s.Log.Errorf("Couldn't remember task %s for tid-%s, the summary of its job won't be logged: %s", job.TaskUUID, tenantID, err)
+	}
+
+	return nil
 }
 
-func (s *Server) getKeys(key string) []string {
-	// TODO: Find a better way to pull this info, this won't scale at all
+// dispatchTenants calls enqueue with the tenants that are due, and records when they were enqueued. The leadership is
+// checked again every leaderCheckInterval tenants, so a scheduler that was deposed meanwhile stops dispatching.
+func (s *Server) dispatchTenants(election *LeaderElection, tick time.Duration, defaultSchedule cron.Schedule, now time.Time, enqueue func(tenantID string) error) {
+	// the stores share a single connection for the whole tick, instead of taking one from the pool per tenant
 	conn := s.RedisPool.Get()
+	defer conn.Close()
 	redisStore := store.NewDefaultRedisStore(conn)
-	tenantScope := redisStore.Key("tenants")
-	redisStore.Scope = tenantScope
-	tenantKey := redisStore.Key(key)
-	keys, err := redis.Strings(redisStore.Conn.Do("KEYS", tenantKey))
+	configurations := s.newTenantConfigurations(redisStore.Sub(storeKey))
+	lastRuns := &LastRuns{store: redisStore.Sub(lastRunsStoreKey)}
+
+	visited := 0
+	err := s.NewTenantIndex().Each(func(tenantID string) bool {
+		visited++
+		if visited%leaderCheckInterval == 0 && !election.IsLeader() {
+			s.Log.Errorf("Not the leader anymore, stopping after %d tenants", visited-1)
+			return false
+		}
+
+		if tick != 0 && !s.isTenantDue(configurations, lastRuns, tenantID, tick, defaultSchedule, now) {
+			return true
+		}
+
+		if err := enqueue(tenantID); err != nil {
+			return true
+		}
+
+		if err := lastRuns.Set(tenantID, now); err != nil {
+			s.Log.Errorf("Failed to record the last run of tid-%s: %s", tenantID, err)
+		}
+		return true
+	})
+	if err != nil {
+		s.Log.Errorf("Error getting the tenants: %s", err)
+	}
+}
+
+// isTenantDue returns true if the schedule of the tenant had a run since the last time it was enqueued. Tenants that
+// were never enqueued are due if their schedule had a run during the last tick, or right away if they use the default
+// schedule, which only has a run a whole SCHEDULER_DURATION after the time it's given.
+func (s *Server) isTenantDue(configurations *TenantConfigurations, lastRuns *LastRuns, tenantID string, tick time.Duration, defaultSchedule cron.Schedule, now time.Time) bool {
+	schedule := defaultSchedule
+	ownSchedule := false
+
+	configuration, err := configurations.Get(tenantID)
+	if err != nil {
+		s.Log.Errorf("Failed to get the configuration of tid-%s, using the default schedule: %s", tenantID, err)
+	} else if schedule, err = configuration.schedule(defaultSchedule); err != nil {
+		s.Log.Errorf("Invalid schedule for tid-%s, using the default schedule: %s", tenantID, err)
+		schedule = defaultSchedule
+	} else {
+		ownSchedule = configuration.Schedule != "" || configuration.DailyAt != ""
+	}
+
+	lastRun, err := lastRuns.Get(tenantID)
+	if err != nil {
+		s.Log.Errorf("Failed to get the last run of tid-%s: %s", tenantID, err)
+		return false
+	}
+
+	if lastRun.IsZero() {
+		if !ownSchedule {
+			return true
+		}
+		lastRun = now.Add(-tick)
+	}
+
+	if !isDue(schedule, lastRun, now) {
+		s.Log.Debugf("tid-%s is not due, last run was %s", tenantID, lastRun)
+		return false
+	}
+
+	return true
+}
+
+// scheduleTask enqueues the autoArchive task of the tenant. The result of the task is the summary of its job.
+func (s *Server) scheduleTask(taskServer *machinery.Server, tenantID string) (*backends.AsyncResult, error) {
+	s.Log.Infof("Start archiving tid-%s", tenantID)
+	return s.sendTask(taskServer, autoArchiveTask, tenantID)
+}
+
+// sendTask enqueues a task that processes the rooms of the tenant. The args are passed to the task after the tenant.
+func (s *Server) sendTask(taskServer *machinery.Server, name string, tenantID string, args ...string) (*backends.AsyncResult, error) {
+	return s.publishTask(taskServer, tenantID, newTaskSignature(name, tenantID, args...))
+}
+
+// newTaskSignature returns the signature of a task of the tenant, whose UUID is generated when it's published unless
+// it's set beforehand
+func newTaskSignature(name string, tenantID string, args ...string) *signatures.TaskSignature {
+	task := &signatures.TaskSignature{
+		Name: name,
+		Args: []signatures.TaskArg{
+			signatures.TaskArg{
+				Type:  "string",
+				Value: tenantID,
+			},
+		},
+	}
+
+	for _, arg := range args {
+		task.Args = append(task.Args, signatures.TaskArg{Type: "string", Value: arg})
+	}
+
+	return task
+}
+
+// publishTask enqueues the task of the tenant
+func (s *Server) publishTask(taskServer *machinery.Server, tenantID string, task *signatures.TaskSignature) (*backends.AsyncResult, error) {
+	result, err := taskServer.SendTask(task)
+	if err != nil {
+		s.Log.Errorf("Failed to schedule task for tid-%s: %s", tenantID, err)
+		return nil, err
+	}
+
+	s.Log.Debugf("Scheduled task %s for tid-%s", result.Signature.UUID, tenantID)
+	return result, nil
+}
+
+// BackfillTenantIndex adds the tenants installed before the tenant index existed to it
+func BackfillTenantIndex() {
+	b := NewBackendServer("hiparchiver.backfill")
+
+	b.Log.Infof("Backfilling the tenant index")
+	found, err := b.NewTenantIndex().Backfill()
 	if err != nil {
-		panic(fmt.Sprintf("Error getting the tenants: %s", err))
+		b.Log.Errorf("Failed to backfill the tenant index after %d tenants: %s", found, err)
+		return
 	}
 
-	return keys
+	b.Log.Infof("Added %d tenants to the tenant index", found)
 }
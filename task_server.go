@@ -6,6 +6,15 @@ import (
 	"github.com/RichardKnop/machinery/v1/config"
 )
 
+const (
+	// autoArchiveTask processes the rooms of a tenant
+	autoArchiveTask = "autoArchive"
+	// previewAutoArchiveTask processes the rooms of a tenant on a dry run
+	previewAutoArchiveTask = "previewAutoArchive"
+	// restoreRoomsTask unarchives the rooms archived by a job, or during a time range
+	restoreRoomsTask = "restoreRooms"
+)
+
 func NewTaskServer() *machinery.Server {
 	var redisEnv = util.Env.GetStringOr("REDIS_WORKER_ENV", "REDIS_URL")
 	var redisURL = util.Env.GetStringOr(redisEnv, "redis://127.0.0.1:6379")
@@ -14,6 +23,8 @@ func NewTaskServer() *machinery.Server {
 		Broker:        redisURL,
 		ResultBackend: redisURL,
 		DefaultQueue:  "machinery_tasks",
+		// Results are the summaries of the jobs, kept for a week so they can be queried by the UUID of their task
+		ResultsExpireIn: taskResultsTTL(),
 	}
 
 	server, err := machinery.NewServer(&cnf)
@@ -23,3 +34,8 @@ func NewTaskServer() *machinery.Server {
 
 	return server
 }
+
+// taskResultsTTL is how many seconds the results of the tasks are kept
+func taskResultsTTL() int {
+	return util.Env.GetIntOr("TASK_RESULTS_TTL", 7*24*3600)
+}
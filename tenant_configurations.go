@@ -3,38 +3,93 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
+	"strings"
+	"time"
 
+	"bitbucket.org/rbergman/go-hipchat-connect/store"
 	_ "github.com/garyburd/redigo/redis"
+	"github.com/tbruyelle/hipchat-go/hipchat"
 )
 
 const storeKey = "configurations"
 
+// defaultUnarchiveCooldownDays is how long rooms that someone unarchived are left alone, unless the tenant says otherwise
+const defaultUnarchiveCooldownDays = 30
+
+// defaultWarningDays is how long before archiving a room we warn it, unless the tenant says otherwise
+const defaultWarningDays = 7
+
 // Tenants manages a collection of known integration tenants
 type TenantConfigurations struct {
 	server *Server
+	store  store.Store
 }
 
 type TenantConfiguration struct {
 	ID        string
 	Threshold int
+	Policy    Policy
+	// WarningDays is how long before archiving a room we warn it. Rooms aren't warned when it's 0.
+	WarningDays int
+	// ActivitySource is either ActivityFromStats (the default) or ActivityFromHistory
+	ActivitySource string
+	// IgnoredSenders are the names of the senders whose messages don't count as activity, when using the history
+	IgnoredSenders []string
+	// PublicThreshold, PrivateThreshold and GuestThreshold replace the threshold for public rooms, private rooms
+	// and rooms with guest access respectively, when they are not 0
+	PublicThreshold  int
+	PrivateThreshold int
+	GuestThreshold   int
+	// DisableGuestAccessDays is how long before archiving a room we turn off its guest access. Guest access is left
+	// alone when it's 0.
+	DisableGuestAccessDays int
+	// DeleteEnabled turns on the permanent deletion of the rooms that we archived DeleteAfterDays ago. It's off
+	// unless the tenant explicitly enables it.
+	DeleteEnabled   bool
+	DeleteAfterDays int
+	// UnarchiveCooldownDays is how long we leave alone a room that someone unarchived after we archived it. The
+	// default cooldown is used when it's 0.
+	UnarchiveCooldownDays int
+	// MinimumAgeDays is how old a room has to be before it can be archived, so rooms created ahead of time aren't
+	// archived before anyone uses them
+	MinimumAgeDays int
+	// Schedule is a cron expression, and DailyAt is a HH:MM time, for when the rooms of the tenant are processed.
+	// They are evaluated in Timezone, or UTC if it's empty. The scheduler's default is used when both are empty.
+	Schedule string
+	DailyAt  string
+	Timezone string
+	// Concurrency is how many rooms of the tenant are processed at the same time, and RequestsPerMinute is how many
+	// requests they can make to HipChat between all of them. The defaults of the deployment are used when they are 0.
+	Concurrency       int
+	RequestsPerMinute int
+	// DryRun makes the jobs of the tenant only record what they would have done, until the day after DryRunUntil if
+	// it's not empty. DryRunUntil is a YYYY-MM-DD date.
+	DryRun      bool
+	DryRunUntil string
 }
 
 func (s *Server) NewTenantConfigurations() *TenantConfigurations {
-	return &TenantConfigurations{server: s}
+	return s.newTenantConfigurations(s.NewTenantStore(storeKey))
+}
+
+// newTenantConfigurations returns the configurations kept in the store, which callers that read many of them pass so
+// they can close its connection
+func (s *Server) newTenantConfigurations(tenantStore store.Store) *TenantConfigurations {
+	return &TenantConfigurations{server: s, store: tenantStore}
 }
 
 // Get returns a TenantConfiguration by id string
 func (t *TenantConfigurations) Get(id string) (*TenantConfiguration, error) {
-	store := t.server.NewTenantStore(storeKey)
-	value, err := store.Get(id)
+	value, err := t.store.Get(id)
 
 	if err != nil {
 		t.server.Log.Debugf("Error when getting configuration for tid-%s: %s", id, err)
 		return &TenantConfiguration{ID: id}, err
 	} else if len(value) == 0 {
 		t.server.Log.Debugf("Didn't find getting configuration for tid-%s, returning default", id)
-		return &TenantConfiguration{ID: id, Threshold: 90}, nil
+		return newDefaultTenantConfiguration(id), nil
 	} else {
 		r := bytes.NewReader([]byte(value))
 		return decode(r)
@@ -49,24 +104,186 @@ func (t *TenantConfigurations) Set(configuration *TenantConfiguration) error {
 		return err
 	}
 
-	store := t.server.NewTenantStore(storeKey)
-	return store.Set(configuration.ID, w.Bytes())
+	return t.store.Set(configuration.ID, w.Bytes())
 }
 
 // Del removes a Tenant by id string
 func (t *TenantConfigurations) Del(id string) error {
-	store := t.server.NewTenantStore(storeKey)
-	return store.Del(id)
+	return t.store.Del(id)
+}
+
+// Decide evaluates the policy of the tenant against the room. Rooms that don't match any rule are archived after
+// the default threshold. guestAccessDisabled is true if we disabled the guest access of the room.
+func (t *TenantConfiguration) Decide(room *hipchat.Room, daysSinceCreated int, guestAccessDisabled bool) Decision {
+	rule := t.Policy.Match(room, daysSinceCreated)
+	if rule == nil {
+		threshold, reason := t.thresholdFor(room, guestAccessDisabled)
+		return Decision{Action: ActionArchive, Threshold: threshold, Reason: reason}
+	}
+
+	return Decision{Action: rule.Action, Threshold: rule.Days, Reason: fmt.Sprintf("rule '%s'", rule.Name)}
+}
+
+// thresholdFor returns the threshold for the privacy class of the room. Guest access takes precedence over privacy,
+// and still applies once we disabled it, so disabling it doesn't give the room the longer threshold of its privacy.
+func (t *TenantConfiguration) thresholdFor(room *hipchat.Room, guestAccessDisabled bool) (int, string) {
+	switch {
+	case t.GuestThreshold != 0 && (isGuestAccessible(room) || guestAccessDisabled):
+		return t.GuestThreshold, "guest access threshold"
+	case t.PrivateThreshold != 0 && room.Privacy == "private":
+		return t.PrivateThreshold, "private threshold"
+	case t.PublicThreshold != 0 && room.Privacy == "public":
+		return t.PublicThreshold, "public threshold"
+	}
+
+	return t.Threshold, "default threshold"
+}
+
+// needsRoomDetails returns true if deciding what to do with a room requires fields that are only returned by the
+// room API, and not by the room list API
+func (t *TenantConfiguration) needsRoomDetails() bool {
+	return t.Policy.needsRoomDetails() || t.GuestThreshold != 0 || t.DisableGuestAccessDays != 0 ||
+		t.MinimumAgeDays != 0
+}
+
+// unarchiveCooldownDays returns the cooldown of the rooms that someone unarchived after we archived them
+func (t *TenantConfiguration) unarchiveCooldownDays() int {
+	if t.UnarchiveCooldownDays > 0 {
+		return t.UnarchiveCooldownDays
+	}
+
+	return defaultUnarchiveCooldownDays
+}
+
+// concurrency returns how many rooms of the tenant are processed at the same time, which is never more than max
+func (t *TenantConfiguration) concurrency(defaultConcurrency int, max int) int {
+	concurrency := defaultConcurrency
+	if t.Concurrency > 0 {
+		concurrency = t.Concurrency
+	}
+
+	if concurrency > max {
+		concurrency = max
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	return concurrency
+}
+
+// requestsPerMinute returns how many requests the rooms of the tenant can make to HipChat, or 0 if there is no limit
+func (t *TenantConfiguration) requestsPerMinute(defaultRequestsPerMinute int) int {
+	if t.RequestsPerMinute > 0 {
+		return t.RequestsPerMinute
+	}
+
+	return defaultRequestsPerMinute
+}
+
+// FieldError is a field of a configuration that isn't valid, and why
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+// ValidationErrors are all the fields of a configuration that aren't valid
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, fieldError := range e {
+		messages[i] = fmt.Sprintf("%s: %s", fieldError.Field, fieldError.Message)
+	}
+
+	return strings.Join(messages, ", ")
+}
+
+// Validate returns the fields of the configuration that aren't valid, or nil if all of them are
+func (t *TenantConfiguration) Validate() ValidationErrors {
+	var errs ValidationErrors
+	invalid := func(field string, format string, args ...interface{}) {
+		errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if t.Threshold < 1 {
+		invalid("Threshold", "Must be greater than 0")
+	}
+
+	days := []struct {
+		field string
+		value int
+	}{
+		{"WarningDays", t.WarningDays},
+		{"PublicThreshold", t.PublicThreshold},
+		{"PrivateThreshold", t.PrivateThreshold},
+		{"GuestThreshold", t.GuestThreshold},
+		{"DisableGuestAccessDays", t.DisableGuestAccessDays},
+		{"DeleteAfterDays", t.DeleteAfterDays},
+		{"UnarchiveCooldownDays", t.UnarchiveCooldownDays},
+		{"MinimumAgeDays", t.MinimumAgeDays},
+		{"Concurrency", t.Concurrency},
+		{"RequestsPerMinute", t.RequestsPerMinute},
+	}
+
+	for _, d := range days {
+		if d.value < 0 {
+			invalid(d.field, "Can't be negative")
+		}
+	}
+
+	if err := t.Policy.Validate(); err != nil {
+		invalid("Policy", "%s", err)
+	}
+
+	if t.ActivitySource != "" && t.ActivitySource != ActivityFromStats && t.ActivitySource != ActivityFromHistory {
+		invalid("ActivitySource", "Must be %s or %s", ActivityFromStats, ActivityFromHistory)
+	}
+
+	for _, sender := range t.IgnoredSenders {
+		if strings.TrimSpace(sender) == "" {
+			invalid("IgnoredSenders", "Sender names can't be empty")
+			break
+		}
+	}
+
+	if t.DeleteEnabled && t.DeleteAfterDays < 1 {
+		invalid("DeleteAfterDays", "Rooms can only be deleted at least one day after archiving them")
+	}
+
+	if _, err := time.LoadLocation(t.Timezone); err != nil {
+		invalid("Timezone", "Unknown timezone '%s'", t.Timezone)
+	} else if _, err := t.schedule(nil); err != nil {
+		field := "Schedule"
+		if t.Schedule == "" {
+			field = "DailyAt"
+		}
+		invalid(field, "%s", err)
+	}
+
+	if err := t.validateDryRunUntil(); err != nil {
+		invalid("DryRunUntil", "%s", err)
+	}
+
+	return errs
+}
+
+// newDefaultTenantConfiguration returns the configuration of a tenant that didn't save one
+func newDefaultTenantConfiguration(id string) *TenantConfiguration {
+	return &TenantConfiguration{ID: id, Threshold: 90, WarningDays: defaultWarningDays}
 }
 
+// decode decodes a stored configuration over the default one, so the configurations saved before a field existed get
+// its default
 func decode(r io.Reader) (*TenantConfiguration, error) {
-	var t TenantConfiguration
+	t := newDefaultTenantConfiguration("")
 	decoder := json.NewDecoder(r)
-	err := decoder.Decode(&t)
+	err := decoder.Decode(t)
 	if err != nil {
-		return &t, err
+		return t, err
 	}
-	return &t, nil
+	return t, nil
 }
 
 func (t *TenantConfiguration) encode(w io.Writer) error {
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateConfiguration(t *testing.T) {
+	tests := []struct {
+		configuration TenantConfiguration
+		fields        []string
+	}{
+		{TenantConfiguration{Threshold: 90, WarningDays: 7}, nil},
+		{TenantConfiguration{Threshold: 0, WarningDays: -1, Concurrency: -2}, []string{"Threshold", "WarningDays", "Concurrency"}},
+		{TenantConfiguration{Threshold: 90, DeleteEnabled: true}, []string{"DeleteAfterDays"}},
+		{TenantConfiguration{Threshold: 90, ActivitySource: "messages", IgnoredSenders: []string{"bot", " "}}, []string{"ActivitySource", "IgnoredSenders"}},
+		{TenantConfiguration{Threshold: 90, Policy: Policy{{Name: "rule", Action: "delete"}}}, []string{"Policy"}},
+		{TenantConfiguration{Threshold: 90, DailyAt: "25:00", Timezone: "Europe/Madrid"}, []string{"DailyAt"}},
+		{TenantConfiguration{Threshold: 90, Schedule: "0 6 * * *", DailyAt: "06:00"}, []string{"Schedule"}},
+		{TenantConfiguration{Threshold: 90, DailyAt: "06:00", Timezone: "Mars/Olympus"}, []string{"Timezone"}},
+		{TenantConfiguration{Threshold: 90, DryRun: true, DryRunUntil: "next week"}, []string{"DryRunUntil"}},
+	}
+
+	for _, tt := range tests {
+		var fields []string
+		for _, fieldError := range tt.configuration.Validate() {
+			fields = append(fields, fieldError.Field)
+		}
+
+		if fmt.Sprint(fields) != fmt.Sprint(tt.fields) {
+			t.Error(fmt.Sprintf("Validation was wrong. Expected=%v Actual=%v Configuration=%+v", tt.fields, fields, tt.configuration))
+		}
+	}
+}
+
+func TestUpdateConfiguration(t *testing.T) {
+	current := &TenantConfiguration{ID: "tenant", Threshold: 90, WarningDays: 7, IgnoredSenders: []string{"bot"}}
+
+	body := `{"Threshold": 30, "Policy": [{"Name": "oncall", "NameGlob": "oncall-*", "Action": "never"}],
+		"WarningDays": 3, "ActivitySource": "history", "IgnoredSenders": ["jira", "jenkins"], "PublicThreshold": 60,
+		"PrivateThreshold": 14, "GuestThreshold": 7, "DisableGuestAccessDays": 1, "DeleteEnabled": true,
+		"DeleteAfterDays": 30, "UnarchiveCooldownDays": 90, "MinimumAgeDays": 7, "Schedule": "",
+		"DailyAt": "06:30", "Timezone": "Europe/Madrid", "Concurrency": 4, "RequestsPerMinute": 100, "DryRun": true,
+		"DryRunUntil": "2016-07-01"}`
+
+	updated, status, errs := updateConfiguration(current, strings.NewReader(body))
+	if errs != nil || status != http.StatusOK {
+		t.Fatal(fmt.Sprintf("Configuration wasn't updated. Status=%d Errors=%v", status, errs))
+	}
+
+	// Every field of the configuration can be set, except for Schedule which can't be used with DailyAt
+	value := reflect.ValueOf(*updated)
+	for i := 0; i < value.NumField(); i++ {
+		name := value.Type().Field(i).Name
+		if name != "Schedule" && reflect.DeepEqual(value.Field(i).Interface(), reflect.Zero(value.Field(i).Type()).Interface()) {
+			t.Error(fmt.Sprintf("%s wasn't set by the update", name))
+		}
+	}
+
+	if current.Threshold != 90 || fmt.Sprint(current.IgnoredSenders) != "[bot]" {
+		t.Error(fmt.Sprintf("Current configuration was changed. Actual=%+v", current))
+	}
+
+	// the lists are replaced as a whole, and kept when the body leaves them out
+	current.Policy = Policy{{Name: "oncall", NameGlob: "oncall-*", Action: ActionNever}}
+	updated, _, _ = updateConfiguration(current, strings.NewReader(`{"policy": [{"Name": "oncall", "Action": "archive", "Days": 30}]}`))
+	if expected := (Policy{{Name: "oncall", Action: ActionArchive, Days: 30}}); fmt.Sprint(updated.Policy) != fmt.Sprint(expected) || fmt.Sprint(updated.IgnoredSenders) != "[bot]" {
+		t.Error(fmt.Sprintf("Lists weren't updated. Expected=%v [bot] Actual=%v %v", expected, updated.Policy, updated.IgnoredSenders))
+	}
+
+	tests := []struct {
+		body   string
+		status int
+		fields []string
+	}{
+		{`{"Threshold": 30`, http.StatusBadRequest, []string{""}},
+		{`{"ID": "other"}`, http.StatusUnprocessableEntity, []string{"ID"}},
+		{`{"Threshold": 0, "DeleteEnabled": true}`, http.StatusUnprocessableEntity, []string{"Threshold", "DeleteAfterDays"}},
+		{`{"threshhold": 30, "warningdays": 14}`, http.StatusUnprocessableEntity, []string{"threshhold"}},
+		{`{"WarningDays": 14}`, http.StatusOK, nil},
+	}
+
+	for _, tt := range tests {
+		_, status, errs := updateConfiguration(current, strings.NewReader(tt.body))
+
+		var fields []string
+		for _, fieldError := range errs {
+			fields = append(fields, fieldError.Field)
+		}
+
+		if status != tt.status || fmt.Sprint(fields) != fmt.Sprint(tt.fields) {
+			t.Error(fmt.Sprintf("Update was wrong. Body=%s Expected=%d %v Actual=%d %v", tt.body, tt.status, tt.fields, status, fields))
+		}
+	}
+}
+
+func TestDefaultWarningDays(t *testing.T) {
+	r := newFakeRedis(&testClock{time.Now()})
+	s := newFakeRedisServer(r)
+	configurations := s.NewTenantConfigurations()
+
+	// saved before warnings existed, and saved without warnings on purpose
+	r.values["hipchat:configurations:old"] = []byte(`{"ID": "old", "Threshold": 30}`)
+	if err := configurations.Set(&TenantConfiguration{ID: "quiet", Threshold: 30, WarningDays: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		tenantID    string
+		warningDays int
+	}{
+		{"unsaved", defaultWarningDays},
+		{"old", defaultWarningDays},
+		{"quiet", 0},
+	}
+
+	for _, tt := range tests {
+		configuration, err := configurations.Get(tt.tenantID)
+		if err != nil || configuration.WarningDays != tt.warningDays {
+			t.Error(fmt.Sprintf("WarningDays was wrong. Tenant=%s Expected=%d Actual=%d Error=%v", tt.tenantID, tt.warningDays, configuration.WarningDays, err))
+		}
+	}
+}
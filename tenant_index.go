@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strings"
+
+	"bitbucket.org/rbergman/go-hipchat-connect/store"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	tenantIndexKey = "tenant-index"
+	tenantsScope   = "tenants"
+	// tenantScanCount is how many entries we ask Redis to look at on every SCAN/SSCAN call
+	tenantScanCount = 100
+)
+
+// TenantIndex is a Redis set with the ids of the installed tenants, so we don't have to look for their keys
+type TenantIndex struct {
+	server *Server
+}
+
+func (s *Server) NewTenantIndex() *TenantIndex {
+	return &TenantIndex{server: s}
+}
+
+// Add adds the tenant to the index
+func (t *TenantIndex) Add(tenantID string) error {
+	return t.do("SADD", tenantID)
+}
+
+// Remove removes the tenant from the index
+func (t *TenantIndex) Remove(tenantID string) error {
+	return t.do("SREM", tenantID)
+}
+
+// Each calls fn with the id of every tenant in the index, until fn returns false. It iterates the index with SSCAN, so
+// it doesn't block Redis no matter how many tenants there are. Tenants may be visited more than once if the index
+// changes meanwhile.
+func (t *TenantIndex) Each(fn func(tenantID string) bool) error {
+	conn := t.server.RedisPool.Get()
+	defer conn.Close()
+
+	key := store.NewDefaultRedisStore(conn).Key(tenantIndexKey)
+	cursor := 0
+	for {
+		var tenantIDs []string
+		var err error
+		cursor, tenantIDs, err = scan(conn, "SSCAN", key, cursor)
+		if err != nil {
+			return err
+		}
+
+		for _, tenantID := range tenantIDs {
+			if !fn(tenantID) {
+				return nil
+			}
+		}
+
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// Backfill adds the tenants stored by the install handler to the index. It's meant to be run once, on deployments
+// that have tenants installed before the index existed. It returns the number of tenants found.
+func (t *TenantIndex) Backfill() (int, error) {
+	conn := t.server.RedisPool.Get()
+	defer conn.Close()
+
+	redisStore := store.NewDefaultRedisStore(conn)
+	prefix := redisStore.Key(tenantsScope) + ":"
+	indexKey := redisStore.Key(tenantIndexKey)
+
+	found := 0
+	cursor := 0
+	for {
+		var keys []string
+		var err error
+		cursor, keys, err = scan(conn, "SCAN", "", cursor, "MATCH", prefix+"*")
+		if err != nil {
+			return found, err
+		}
+
+		for _, key := range keys {
+			tenantID := strings.TrimPrefix(key, prefix)
+			if _, err := conn.Do("SADD", indexKey, tenantID); err != nil {
+				return found, err
+			}
+			found++
+		}
+
+		if cursor == 0 {
+			return found, nil
+		}
+	}
+}
+
+func (t *TenantIndex) do(command string, tenantID string) error {
+	conn := t.server.RedisPool.Get()
+	defer conn.Close()
+
+	key := store.NewDefaultRedisStore(conn).Key(tenantIndexKey)
+	_, err := conn.Do(command, key, tenantID)
+	return err
+}
+
+// scan runs a single SCAN-like command from the cursor, and returns the next cursor and the values found. key is
+// empty for SCAN, which doesn't take one.
+func scan(conn redis.Conn, command string, key string, cursor int, args ...interface{}) (int, []string, error) {
+	commandArgs := []interface{}{}
+	if key != "" {
+		commandArgs = append(commandArgs, key)
+	}
+	commandArgs = append(commandArgs, cursor)
+	commandArgs = append(commandArgs, args...)
+	commandArgs = append(commandArgs, "COUNT", tenantScanCount)
+
+	values, err := redis.Values(conn.Do(command, commandArgs...))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var found []string
+	_, err = redis.Scan(values, &cursor, &found)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return cursor, found, nil
+}
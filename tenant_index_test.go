@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestTenantIndexEach(t *testing.T) {
+	s := newFakeRedisServer(newFakeRedis(&testClock{time.Now()}))
+	index := s.NewTenantIndex()
+
+	// more tenants than a single SSCAN returns, so the index is iterated in pages
+	var expected []string
+	for i := 0; i < tenantScanCount*2+5; i++ {
+		tenantID := fmt.Sprintf("tenant-%03d", i)
+		expected = append(expected, tenantID)
+		if err := index.Add(tenantID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := index.Remove("tenant-007"); err != nil {
+		t.Fatal(err)
+	}
+	expected = append(expected[:7], expected[8:]...)
+
+	var found []string
+	err := index.Each(func(tenantID string) bool {
+		found = append(found, tenantID)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(found)
+	if fmt.Sprint(found) != fmt.Sprint(expected) {
+		t.Errorf("TenantIndex.Each was wrong. Expected=%d tenants Actual=%d %v", len(expected), len(found), found)
+	}
+}
+
+func TestTenantIndexBackfill(t *testing.T) {
+	r := newFakeRedis(&testClock{time.Now()})
+	s := newFakeRedisServer(r)
+
+	for i := 0; i < tenantScanCount+5; i++ {
+		r.values[fmt.Sprintf("hipchat:tenants:tenant-%03d", i)] = []byte("{}")
+	}
+	r.values["hipchat:overrides:tenant-000"] = []byte("{}")
+
+	found, err := s.NewTenantIndex().Backfill()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found != tenantScanCount+5 {
+		t.Errorf("TenantIndex.Backfill found the wrong number of tenants. Expected=%d Actual=%d", tenantScanCount+5, found)
+	}
+
+	count := 0
+	s.NewTenantIndex().Each(func(tenantID string) bool {
+		count++
+		return true
+	})
+	if count != found || !r.sets["hipchat:tenant-index"]["tenant-104"] {
+		t.Errorf("TenantIndex.Backfill didn't index the tenants. Expected=%d Actual=%d", found, count)
+	}
+}
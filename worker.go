@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"net/http"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -24,8 +26,30 @@ import (
 // WorkerQueue keeps all the jobs to be executed
 var WorkerQueue chan chan WorkRequest
 
+// workerDone is closed once the worker process is asked to quit, so the tasks still waiting for a worker requeue their
+// work instead. pendingWork is how many tasks are waiting for their work, the process doesn't exit until it's 0.
+var (
+	workerDone  <-chan struct{}
+	pendingWork int32
+)
+
 const keenFlushInterval = 10 * time.Second
 
+// lockTTL is how long the lock of a tenant lasts if the worker holding it stops renewing it
+const lockTTL = 2 * time.Minute
+
+// roomOutcome is what happened to a room after processing it
+type roomOutcome int
+
+const (
+	roomSkipped roomOutcome = iota
+	roomFailed
+	roomTouched
+	roomNotified
+	roomWarned
+	roomArchived
+)
+
 type archivedEvent struct {
 	TenantID  string
 	Archived  int
@@ -33,6 +57,22 @@ type archivedEvent struct {
 	Duration  float64
 }
 
+type rateLimitEvent struct {
+	TenantID        string
+	Requests        int
+	TooManyRequests int
+	Pauses          int
+	Waited          float64
+	Remaining       int
+	Limit           int
+}
+
+type lockEvent struct {
+	TenantID string
+	Outcome  string
+	Fence    int64
+}
+
 // StartWorker starts the worker jobs of the process. It will start a number of workers equal to the value of the WORKERS_ENV env var, or 1
 func StartWorker() {
 	b := NewBackendServer("hiparchiver.workers")
@@ -48,34 +88,47 @@ func StartWorker() {
 	WorkerQueue = make(chan chan WorkRequest, numWorkers)
 	wg := &sync.WaitGroup{}
 
-	internalWorkers := b.startInternalWorkers(numWorkers, wg, maxRoomsToProcess)
+	ctx, cancel := context.WithCancel(context.Background())
+	workerDone = ctx.Done()
 
-	// this is the server that picks up jobs from the queue
+	// this is the server that picks up jobs from the queue, and requeues the interrupted ones
 	taskServer := NewTaskServer()
-	taskServer.RegisterTask("autoArchive", b.autoArchive)
+	b.TaskServer = taskServer
+	internalWorkers := b.startInternalWorkers(ctx, numWorkers, wg, maxRoomsToProcess)
+
+	taskServer.RegisterTask(autoArchiveTask, b.autoArchive)
+	taskServer.RegisterTask(previewAutoArchiveTask, b.previewAutoArchive)
+	taskServer.RegisterTask(restoreRoomsTask, b.restoreArchivedRooms)
 	worker := taskServer.NewWorker(fmt.Sprintf("%s:machinery-worker", hostname))
 
-	go b.handleExitSignal(internalWorkers, worker, wg)
+	stopped := b.handleExitSignal(cancel, internalWorkers, worker, wg)
 
 	err = worker.Launch()
 	if err != nil {
 		panic(err)
 	}
+
+	// Launch returns as soon as the exit signal stops the consumption of tasks, so the process waits for the workers
+	<-stopped
 }
 
-func (server *Server) startInternalWorkers(numWorkers int, wg *sync.WaitGroup, maxRoomsToProcess int) *[]Worker {
+func (server *Server) startInternalWorkers(ctx context.Context, numWorkers int, wg *sync.WaitGroup, maxRoomsToProcess int) *[]Worker {
 	internalWorkers := make([]Worker, numWorkers)
 
 	for i := range internalWorkers {
 		server.Log.Infof("Starting worker-%d", i+1)
 		internalWorkers[i] = server.newWorker(i+1, WorkerQueue)
-		internalWorkers[i].start(server, wg, maxRoomsToProcess)
+		internalWorkers[i].start(ctx, server, wg, maxRoomsToProcess)
 	}
 
 	return &internalWorkers
 }
 
-func (server *Server) handleExitSignal(internalWorkers *[]Worker, worker *machinery.Worker, wg *sync.WaitGroup) {
+// handleExitSignal stops the workers when the process is asked to quit. The process stops taking tasks first, so the
+// jobs in progress that are interrupted and requeued are left to another process, like the tasks that were taken but
+// are still waiting for a worker. Workers that don't stop within SHUTDOWN_TIMEOUT seconds are abandoned. The returned
+// channel is closed once the workers are stopped and the waiting tasks requeued.
+func (server *Server) handleExitSignal(cancel context.CancelFunc, internalWorkers *[]Worker, worker *machinery.Worker, wg *sync.WaitGroup) <-chan struct{} {
 	sChan := make(chan os.Signal, 1)
 	signal.Notify(sChan,
 		syscall.SIGHUP,
@@ -83,20 +136,39 @@ func (server *Server) handleExitSignal(internalWorkers *[]Worker, worker *machin
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
 
+	done := make(chan struct{})
 	go func() {
 		// catch quit signal
 		s := <-sChan
 		server.Log.Infof("Signal %s received, stopping workers", s)
 
+		worker.Quit()
+		cancel()
 		for _, iw := range *internalWorkers {
 			iw.stop()
 		}
 
-		wg.Wait()
-		worker.Quit()
+		stopped := make(chan struct{})
+		go func() {
+			wg.Wait()
+			for atomic.LoadInt32(&pendingWork) > 0 {
+				time.Sleep(100 * time.Millisecond)
+			}
+			close(stopped)
+		}()
+
+		shutdownTimeout := time.Duration(util.Env.GetIntOr("SHUTDOWN_TIMEOUT", 30)) * time.Second
+		select {
+		case <-stopped:
+			server.Log.Infof("Workers stopped")
+		case <-time.After(shutdownTimeout):
+			server.Log.Errorf("Workers didn't stop after %s, quitting anyway", shutdownTimeout)
+		}
 
-		return
+		close(done)
 	}()
+
+	return done
 }
 
 // NewWorker creates, and returns a new Worker object. Its only argument
@@ -117,7 +189,7 @@ func (server *Server) newWorker(id int, workerQueue chan chan WorkRequest) Worke
 
 // This function "starts" the worker by starting a goroutine, that is
 // an infinite "for-select" loop.
-func (w Worker) start(s *Server, wg *sync.WaitGroup, maxRoomsToProcess int) {
+func (w Worker) start(ctx context.Context, s *Server, wg *sync.WaitGroup, maxRoomsToProcess int) {
 	wg.Add(1)
 
 	go func() {
@@ -135,36 +207,44 @@ func (w Worker) start(s *Server, wg *sync.WaitGroup, maxRoomsToProcess int) {
 				jobID := uuid.NewV4().String()
 				w.Log.Infof("worker%d: Received work request for tid-%s", w.ID, work.TenantID)
 
-				tenants := s.NewTenants()
-				tenant, err := tenants.Get(work.TenantID)
-				if err != nil {
-					w.Log.Errorf("Coudn't find tid-%s", work.TenantID)
+				if ctx.Err() != nil {
+					// the process is quitting, the job is left to another process
+					s.requeue(work)
+					work.done(&JobSummary{JobID: jobID, TenantID: work.TenantID, DryRun: work.DryRun, Interrupted: true})
 					continue
 				}
 
-				tenantConfigurations := s.NewTenantConfigurations()
-				tenantConfiguration, err := tenantConfigurations.Get(tenant.ID)
-
+				lock, err := s.AcquireTenantLock(work.TenantID, lockTTL)
 				if err != nil {
-					w.Log.Errorf("Coudn't find a configuration for tid-%s", work.TenantID)
+					w.Log.Errorf("Couldn't lock tid-%s, skipping: %v", work.TenantID, err)
+					w.sendEvent("tenant-lock", &lockEvent{TenantID: work.TenantID, Outcome: "error"})
+					work.done(&JobSummary{JobID: jobID, TenantID: work.TenantID, Error: fmt.Sprintf("Couldn't lock the tenant: %v", err)})
+					continue
+				} else if lock == nil {
+					w.Log.Infof("tid-%s is already being processed by another worker, skipping", work.TenantID)
+					w.sendEvent("tenant-lock", &lockEvent{TenantID: work.TenantID, Outcome: "conflict"})
+					work.done(&JobSummary{JobID: jobID, TenantID: work.TenantID, Error: "The tenant is already being processed by another worker"})
 					continue
 				}
 
-				job := Job{
-					Log:        w.Log.Record("jid", jobID).Record("tid", work.TenantID).Child(),
-					JobID:      jobID,
-					TenantID:   work.TenantID,
-					Clock:      &realClock{},
-					HipChatURL: tenant.Links.Base,
-					DryRun:     util.Env.GetInt("DRYRUN_ENV") == 1,
+				w.Log.Debugf("Locked tid-%s with fence %d", work.TenantID, lock.Fence)
+				summary := w.process(ctx, s, work, jobID, lock, startTime, maxRoomsToProcess)
+
+				if lock.Lost() {
+					w.Log.Errorf("Lost the lock of tid-%s while processing it", work.TenantID)
+					w.sendEvent("tenant-lock", &lockEvent{TenantID: work.TenantID, Outcome: "lost", Fence: lock.Fence})
 				}
 
-				processedRooms, archivedRooms := w.autoArchiveRooms(&job, tenantConfiguration.Threshold, maxRoomsToProcess, startTime, tenant)
-				elapsedTime := time.Since(startTime)
+				if err := lock.Release(); err != nil {
+					w.Log.Errorf("Couldn't release the lock of tid-%s: %v", work.TenantID, err)
+				}
 
-				w.sendAnalytics(work.TenantID, archivedRooms, processedRooms, elapsedTime)
+				if summary.Interrupted {
+					// The lock is released first, so the worker that picks up the task can take it
+					s.requeue(work)
+				}
 
-				job.Log.Infof("Finished work request, archived %d/%d rooms, it took %.2f seconds", archivedRooms, processedRooms, elapsedTime.Seconds())
+				work.done(summary)
 
 			case <-w.QuitChan:
 				// We have been asked to stop.
@@ -175,25 +255,147 @@ func (w Worker) start(s *Server, wg *sync.WaitGroup, maxRoomsToProcess int) {
 	}()
 }
 
-func (w Worker) autoArchiveRooms(job *Job, threshold int, maxRoomsToProcess int, startTime time.Time, tenant *tenant.Tenant) (int, int) {
+// process processes the rooms of the tenant of the work request, while holding its lock, and returns the summary of
+// the job. The summary says if the job was interrupted before processing all the rooms, after saving its checkpoint.
+func (w Worker) process(ctx context.Context, s *Server, work WorkRequest, jobID string, lock *Lease, startTime time.Time, maxRoomsToProcess int) *JobSummary {
+	failed := func(format string, args ...interface{}) *JobSummary {
+		w.Log.Errorf(format+" for tid-%s", append(args, work.TenantID)...)
+		return &JobSummary{JobID: jobID, TenantID: work.TenantID, Error: fmt.Sprintf(format, args...)}
+	}
+
+	tenants := s.NewTenants()
+	tenant, err := tenants.Get(work.TenantID)
+	if err != nil {
+		return failed("Couldn't find the tenant")
+	}
 
-	processedRooms := 0
-	archivedRooms := 0
+	tenantConfigurations := s.NewTenantConfigurations()
+	tenantConfiguration, err := tenantConfigurations.Get(tenant.ID)
 
-	client, err := w.getClient(tenant)
 	if err != nil {
+		return failed("Couldn't find a configuration")
+	}
+
+	roomOverrides, err := s.NewRoomOverrides().Get(tenant.ID)
+	if err != nil {
+		return failed("Couldn't get the room overrides")
+	}
+
+	// the states and the checkpoint are fenced, so they can't be overwritten once another worker took the lock
+	checkpoints := newCheckpoints(s.FencedStore(checkpointsStoreKey, lock))
+	dryRun := work.DryRun || tenantConfiguration.isDryRun(startTime) || util.Env.GetInt("DRYRUN_ENV") == 1
+
+	// dry runs don't save checkpoints, so they start over instead of resuming the checkpoint of a real run
+	var checkpoint *Checkpoint
+	if !dryRun {
+		checkpoint, err = checkpoints.Get(tenant.ID)
+		if err != nil {
+			w.Log.Errorf("Coudn't get the checkpoint for tid-%s, starting over: %v", work.TenantID, err)
+		}
+	}
+
+	if checkpoint != nil {
+		w.Log.Infof("Resuming jid-%s for tid-%s, started at %s", checkpoint.JobID, work.TenantID, checkpoint.StartedAt)
+		jobID = checkpoint.JobID
+	} else {
+		checkpoint = newCheckpoint(jobID, startTime)
+	}
+
+	job := Job{
+		Log:         w.Log.Record("jid", jobID).Record("tid", work.TenantID).Child(),
+		JobID:       jobID,
+		TenantID:    work.TenantID,
+		Clock:       &realClock{},
+		HipChatURL:  tenant.Links.Base,
+		DryRun:      dryRun,
+		States:      newRoomStates(s.FencedStore(roomStatesStoreKey, lock).Sub(tenant.ID)),
+		Lock:        lock,
+		Checkpoints: checkpoints,
+		Concurrency: tenantConfiguration.concurrency(util.Env.GetIntOr("ROOM_CONCURRENCY", 1), util.Env.GetIntOr("MAX_ROOM_CONCURRENCY", 10)),
+	}
+
+	bucket := NewTokenBucket(tenantConfiguration.requestsPerMinute(util.Env.GetIntOr("REQUESTS_PER_MINUTE", 0)), util.Env.GetIntOr("REQUESTS_BURST", 10))
+	job.HTTPClient = newRateLimitedClient(ctx, w.newHTTPClient(), bucket, job.Log)
+
+	processedRooms, archivedRooms, interrupted := w.autoArchiveRooms(ctx, &job, tenantConfiguration, roomOverrides, maxRoomsToProcess, startTime, tenant, checkpoint)
+	elapsedTime := time.Since(startTime)
+
+	w.sendAnalytics(work.TenantID, archivedRooms, processedRooms, elapsedTime)
+
+	rateLimit := job.HTTPClient.State()
+	job.Log.Infof("Made %d requests to HipChat, %d got a 429, paused %d times, waited %.2f seconds, %d/%d requests left until %s",
+		rateLimit.Requests, rateLimit.TooManyRequests, rateLimit.Pauses, rateLimit.Waited.Seconds(), rateLimit.Remaining, rateLimit.Limit, rateLimit.Reset)
+	w.sendEvent("tenant-rate-limit", &rateLimitEvent{
+		TenantID:        work.TenantID,
+		Requests:        rateLimit.Requests,
+		TooManyRequests: rateLimit.TooManyRequests,
+		Pauses:          rateLimit.Pauses,
+		Waited:          rateLimit.Waited.Seconds(),
+		Remaining:       rateLimit.Remaining,
+		Limit:           rateLimit.Limit,
+	})
+
+	job.Log.Infof("Finished work request, archived %d/%d rooms, it took %.2f seconds", archivedRooms, processedRooms, elapsedTime.Seconds())
+
+	summary := newJobSummary(&job, checkpoint, elapsedTime)
+	summary.Interrupted = interrupted
+	if processedRooms < 0 {
+		summary.Error = "Couldn't get the rooms"
+	}
+
+	// Previews are only shown to whoever asked for them, the other jobs are kept for the admin to review
+	if !work.DryRun {
+		finishedAt := time.Now()
+		err = s.NewJobHistory().Add(work.TenantID, newJobRecord(summary, checkpoint.StartedAt, finishedAt), job.audit)
+		if err != nil {
+			job.Log.Errorf("Couldn't save the job in the history: %v", err)
+		}
+
+		if job.DryRun && summary.Error == "" && !interrupted {
+			err = s.NewDryRunReports().Set(work.TenantID, newDryRunReport(summary, finishedAt))
+			if err != nil {
+				job.Log.Errorf("Couldn't save the report of the dry run: %v", err)
+			}
+		}
+	}
+
+	return summary
+}
+
+// autoArchiveRooms processes the rooms of the tenant. It returns the number of rooms processed and archived, and true
+// if it was interrupted by ctx, in which case the checkpoint is saved so the job can be resumed. The checkpoint is also
+// kept when the job stops after MAX_ROOMS rooms, so the next run of the tenant resumes it with the rooms that are left
+// instead of starting over, and only deletes archived rooms once it went through all of them.
+func (w Worker) autoArchiveRooms(ctx context.Context, job *Job, configuration *TenantConfiguration, overrides map[int]RoomOverride, maxRoomsToProcess int, startTime time.Time, tenant *tenant.Tenant, checkpoint *Checkpoint) (int, int, bool) {
+
+	processedRooms := 0
+
+	client, err := w.getClient(tenant, job.HTTPClient)
+	if err != nil && ctx.Err() != nil {
+		job.Log.Infof("Interrupted before getting a token")
+		return checkpoint.Processed, checkpoint.Archived, true
+	} else if err != nil {
 		// this typically means the group uninstalled the plugin
 		w.Log.Errorf("Couldn't get a token: %v", err)
-		return processedRooms, archivedRooms
+		return checkpoint.Processed, checkpoint.Archived, false
 	}
 
 	job.Client = client
 
 	rooms, err := job.GetRooms()
 
-	if err != nil {
+	if err != nil && ctx.Err() != nil {
+		// the rate limit stopped waiting because the process is quitting, the job is resumed by another process
+		job.Log.Infof("Interrupted before getting the rooms")
+		return checkpoint.Processed, checkpoint.Archived, true
+	} else if err != nil {
 		w.Log.Errorf("Failed to retrieve rooms")
-		return -1, -1
+		return -1, -1, false
+	}
+
+	if checkpoint.Processed > 0 {
+		rooms = checkpoint.remaining(rooms)
+		job.Log.Infof("Resuming from checkpoint, %d rooms already processed, %d remaining", checkpoint.Processed, len(rooms))
 	}
 
 	// Shuffle rooms to make sure we don't always hit the oldest one first
@@ -202,69 +404,485 @@ func (w Worker) autoArchiveRooms(job *Job, threshold int, maxRoomsToProcess int,
 		rooms[i], rooms[j] = rooms[j], rooms[i]
 	}
 
-	for _, room := range rooms {
+	handle := func(result roomResult) {
+		if result.outcome == roomFailed {
+			checkpoint.Errors++
+			return
+		}
+
+		checkpoint.markProcessed(result.room.ID, result.outcome == roomArchived)
+		if result.outcome == roomWarned {
+			checkpoint.Warned++
+		}
+
+		processedRooms++
+		if processedRooms%checkpointInterval == 0 {
+			job.saveCheckpoint(checkpoint)
+		}
+
+		if processedRooms%100 == 0 {
+			job.Log.Infof("%d/%d rooms processed", processedRooms, len(rooms))
+			job.Log.Infof("%d rooms archived so far", checkpoint.Archived)
+		}
+	}
+
+	processors := job.startRoomProcessors(configuration, overrides, handle)
+	// stopped waits for the rooms being processed, so the checkpoint saved afterwards includes them
+	stopped := func() (int, int, bool) {
+		processors.stop()
+		job.saveCheckpoint(checkpoint)
+		return checkpoint.Processed, checkpoint.Archived, false
+	}
+
+	for i := range rooms {
+
+		select {
+		case <-ctx.Done():
+			job.Log.Infof("Interrupted after %d rooms, saving the checkpoint", processedRooms)
+			stopped()
+			return checkpoint.Processed, checkpoint.Archived, true
+		default:
+		}
+
+		if job.Lock != nil && job.Lock.Lost() {
+			job.Log.Errorf("Lost the lock of the tenant, stopping after %d rooms", processedRooms)
+			return stopped()
+		}
 
 		elapsedTime := time.Since(startTime)
 		if elapsedTime.Seconds() > 3000 {
-			// We need to refresh the token every hour
+			// We need to refresh the token every hour. The processors use the client, so it's replaced once the rooms
+			// being processed are done.
 			w.Log.Infof("Renewing client, since it's been %f seconds", elapsedTime.Seconds())
-			client, err := w.getClient(tenant)
+			processors.wait()
+			client, err := w.getClient(tenant, job.HTTPClient)
 			if err != nil {
 				w.Log.Errorf("Failed to refresh the client token: %v", err)
-				break
+				return stopped()
 			}
 
 			job.Client = client
 			startTime = time.Now()
 		}
 
-		roomStatistics, err := job.GetRoomStats(room.ID)
+		if processedRooms > maxRoomsToProcess {
+			job.Log.Infof("Quota of %d rooms reached", maxRoomsToProcess)
+			return stopped()
+		}
+
+		processors.submit(&rooms[i])
+	}
+
+	processors.stop()
+	job.finishCheckpoint()
+
+	if configuration.DeleteEnabled && configuration.DeleteAfterDays > 0 {
+		deletedRooms := job.deleteArchivedRooms(ctx, configuration.DeleteAfterDays)
+		job.Log.Infof("Deleted %d rooms archived more than %d days ago", deletedRooms, configuration.DeleteAfterDays)
+	}
+
+	return checkpoint.Processed, checkpoint.Archived, false
+}
+
+// roomResult is the outcome of processing a room
+type roomResult struct {
+	room    *hipchat.Room
+	outcome roomOutcome
+}
+
+// roomProcessors process the rooms submitted to them with Concurrency long-lived goroutines, so a slow room only holds
+// back the goroutine processing it. The results are handled by the goroutine that submits the rooms.
+type roomProcessors struct {
+	rooms    chan *hipchat.Room
+	results  chan roomResult
+	handle   func(roomResult)
+	inFlight int
+}
+
+// startRoomProcessors starts the goroutines that process the rooms of the job, which are stopped by stop
+func (j *Job) startRoomProcessors(configuration *TenantConfiguration, overrides map[int]RoomOverride, handle func(roomResult)) *roomProcessors {
+	concurrency := j.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	p := &roomProcessors{
+		rooms:   make(chan *hipchat.Room),
+		results: make(chan roomResult),
+		handle:  handle,
+	}
+
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			for room := range p.rooms {
+				p.results <- roomResult{room: room, outcome: j.processRoom(room, configuration, overrides)}
+			}
+		}()
+	}
+
+	return p
+}
+
+// submit hands the room to the first processor that is free, handling the results that are ready meanwhile
+func (p *roomProcessors) submit(room *hipchat.Room) {
+	for {
+		select {
+		case p.rooms <- room:
+			p.inFlight++
+			return
+		case result := <-p.results:
+			p.inFlight--
+			p.handle(result)
+		}
+	}
+}
+
+// wait handles the results of the rooms being processed
+func (p *roomProcessors) wait() {
+	for p.inFlight > 0 {
+		p.inFlight--
+		p.handle(<-p.results)
+	}
+}
+
+// stop waits for the rooms being processed, and stops the processors
+func (p *roomProcessors) stop() {
+	p.wait()
+	close(p.rooms)
+}
+
+// processRooms processes the rooms with the processors of the job, and returns their outcomes in the same order
+func (j *Job) processRooms(rooms []hipchat.Room, configuration *TenantConfiguration, overrides map[int]RoomOverride) []roomOutcome {
+	outcomes := make([]roomOutcome, len(rooms))
+	indexes := map[*hipchat.Room]int{}
+	processors := j.startRoomProcessors(configuration, overrides, func(result roomResult) {
+		outcomes[indexes[result.room]] = result.outcome
+	})
 
+	for i := range rooms {
+		indexes[&rooms[i]] = i
+		processors.submit(&rooms[i])
+	}
+
+	processors.stop()
+	return outcomes
+}
+
+// processRoom decides what to do with a single room, and does it. What it did is recorded for the history.
+func (j *Job) processRoom(room *hipchat.Room, configuration *TenantConfiguration, overrides map[int]RoomOverride) (outcome roomOutcome) {
+	var decision Decision
+	var idleDays int
+	defer func() { j.recordAudit(room, outcome, decision.Reason, idleDays) }()
+
+	state, err := j.States.Get(room.ID)
+	if err != nil {
+		j.Log.Errorf("Couldn't retrieve the state of room %d, ignoring: %v", room.ID, err)
+		return roomFailed
+	}
+
+	// The archive of a room that is seen unarchived is forgotten first, so it's never deleted if it's archived again
+	if j.isKeptAfterUnarchive(room.ID, configuration.unarchiveCooldownDays(), state) {
+		return roomSkipped
+	}
+
+	override, hasOverride := overrides[room.ID]
+	if hasOverride && override.Exempt {
+		j.Log.Record("rid", room.ID).Infof("Skipping due to room override")
+		return roomSkipped
+	}
+
+	var roomStatistics *hipchat.RoomStatistics
+	neverUsed := false
+	daysSinceLastActive := -1
+
+	if configuration.ActivitySource == ActivityFromHistory {
+		daysSinceLastActive, err = j.GetDaysSinceLastHumanMessage(room.ID, configuration.IgnoredSenders)
 		if err != nil {
-			job.Log.Errorf("Couldn't retrieve the stats of room %d, ignoring: %v", room.ID, err)
-			continue
+			j.Log.Errorf("Couldn't retrieve the history of room %d, ignoring: %v", room.ID, err)
+			return roomFailed
 		}
 
-		daysSinceLastActive := -1
-		if roomStatistics.MessagesSent == 0 {
-			r, err := job.GetRoom(room.ID)
-			if err != nil {
-				job.Log.Infof("Couldn't retrieve the room: %v", err)
-				continue
-			}
+		neverUsed = daysSinceLastActive == -1
+	} else {
+		roomStatistics, err = j.getListedRoomStats(room.ID)
+		if err != nil {
+			j.Log.Errorf("Couldn't retrieve the stats of room %d, ignoring: %v", room.ID, err)
+			return roomFailed
+		}
+
+		neverUsed = roomStatistics.MessagesSent == 0
+		if !neverUsed {
+			daysSinceLastActive = j.GetDaysSinceLastActive(room.ID, roomStatistics)
+		}
+	}
+
+	daysSinceCreated := -1
+	if neverUsed || configuration.needsRoomDetails() {
+		r, err := j.getRoomDetails(room)
+		if err != nil {
+			j.Log.Infof("Couldn't retrieve the room: %v", err)
+			return roomFailed
+		}
+
+		room = r
+		daysSinceCreated = j.GetDaysSinceCreated(room)
+	}
+
+	if neverUsed {
+		daysSinceLastActive = daysSinceCreated
+	}
+
+	decision = configuration.Decide(room, daysSinceCreated, !state.GuestAccessDisabledAt.IsZero())
+	decision = j.applyTopicDirective(room.ID, room.Topic, decision)
+	if hasOverride {
+		decision = override.decision()
+	}
+
+	j.Log.Record("rid", room.ID).Debugf("Decided to %s after %d days due to %s", decision.Action, decision.Threshold, decision.Reason)
+
+	if decision.Action == ActionNever {
+		j.Log.Record("rid", room.ID).Infof("Skipping due to %s", decision.Reason)
+		return roomSkipped
+	}
+
+	if !j.IsOldEnoughToArchive(room.ID, daysSinceCreated, configuration.MinimumAgeDays, room.Topic) {
+		return roomSkipped
+	}
+
+	if daysSinceLastActive == -1 {
+		if state.IdleSince.IsZero() {
+			j.TouchRoom(room.ID, decision.Threshold)
+			j.recordNotification(room.ID, 0, state)
+			return roomTouched
+		}
+
+		idleDays = j.GetDaysSinceFirstObservedIdle(room.ID, state)
+	} else {
+		idleDays = j.resolveIdleDays(room.ID, daysSinceLastActive, roomStatistics, state)
+	}
+
+	if decision.Action == ActionArchive && configuration.DisableGuestAccessDays > 0 && isGuestAccessible(room) &&
+		j.ShouldWarnRoom(room.ID, idleDays, decision.Threshold, configuration.DisableGuestAccessDays, room.Topic) {
+		err = j.DisableGuestAccess(room, idleDays)
+		if err == nil {
+			room.IsGuestAccessible = false
+			room.GuestAccessURL = ""
+			state.GuestAccessDisabledAt = j.Clock.Now()
+			j.recordNotification(room.ID, idleDays, state)
+		}
+	}
+
+	if decision.Action == ActionNotify {
+		if !j.ShouldArchiveRoom(room.ID, idleDays, decision.Threshold, room.Topic) || !state.NotifiedAt.IsZero() {
+			return roomSkipped
+		}
+
+		j.NotifyIdleRoom(room.ID, idleDays)
+		j.recordNotification(room.ID, idleDays, state)
+		return roomNotified
+	}
+
+	if configuration.WarningDays > 0 {
+		return j.warnOrArchiveRoom(room, idleDays, decision.Threshold, configuration.WarningDays, state)
+	}
+
+	if !j.ShouldArchiveRoom(room.ID, idleDays, decision.Threshold, room.Topic) {
+		return roomSkipped
+	}
+
+	return j.archiveRoom(room, idleDays, state)
+}
+
+// warnOrArchiveRoom warns rooms that are going to be archived in warningDays or less, and archives them once the
+// warning has been up for at least warningDays. Rooms that are no longer close to the threshold get their warning
+// cleared.
+func (j *Job) warnOrArchiveRoom(room *hipchat.Room, idleDays int, threshold int, warningDays int, state *RoomState) roomOutcome {
+	if !j.ShouldWarnRoom(room.ID, idleDays, threshold, warningDays, room.Topic) {
+		if !state.WarnedAt.IsZero() {
+			j.Log.Record("rid", room.ID).Infof("Room is no longer close to the threshold, clearing the warning")
+			*state = RoomState{GuestAccessDisabledAt: state.GuestAccessDisabledAt}
+			j.saveRoomState(room.ID, state)
+		}
+
+		return roomSkipped
+	}
+
+	if state.WarnedAt.IsZero() {
+		daysUntilArchived := threshold - idleDays
+		if daysUntilArchived < warningDays {
+			daysUntilArchived = warningDays
+		}
+
+		j.WarnRoom(room.ID, idleDays, daysUntilArchived)
+		if j.DryRun && j.ShouldArchiveRoom(room.ID, idleDays, threshold, room.Topic) {
+			// Dry runs don't remember their warnings, so the rooms past the threshold would never be archived
+			j.recordWouldArchive(room, idleDays, true)
+		}
+
+		state.WarnedAt = j.Clock.Now()
+		j.recordNotification(room.ID, idleDays, state)
+		return roomWarned
+	}
+
+	if daysBetween(state.WarnedAt, j.Clock.Now()) < warningDays || !j.ShouldArchiveRoom(room.ID, idleDays, threshold, room.Topic) {
+		j.Log.Record("rid", room.ID).Debugf("Room was warned on %s, waiting for the grace period to expire", state.WarnedAt)
+		return roomSkipped
+	}
+
+	return j.archiveRoom(room, idleDays, state)
+}
 
-			daysSinceLastActive = job.GetDaysSinceCreated(r)
+// archiveRoom archives the room, and remembers when we did it. On dry runs, it remembers the room would have been
+// archived instead.
+func (j *Job) archiveRoom(room *hipchat.Room, idleDays int, state *RoomState) roomOutcome {
+	if !j.holdsLock() {
+		j.Log.Record("rid", room.ID).Errorf("Not archiving, the lock of the tenant was lost")
+		return roomSkipped
+	}
+
+	err := j.ArchiveRoom(room.ID, idleDays)
+	if err != nil {
+		j.Log.Errorf("Error when archiving rid-%d: %v", room.ID, err)
+		return roomSkipped
+	}
+
+	if j.DryRun {
+		j.recordWouldArchive(room, idleDays, false)
+	}
+
+	*state = RoomState{ArchivedAt: j.Clock.Now()}
+	if !j.DryRun {
+		if stats, err := j.GetRoomStats(room.ID); err != nil {
+			j.Log.Record("rid", room.ID).Errorf("Couldn't get the last active date after archiving: %v", err)
 		} else {
-			daysSinceLastActive = job.GetDaysSinceLastActive(room.ID, roomStatistics)
+			state.ArchivedLastActive = stats.LastActive
 		}
+	}
 
-		if daysSinceLastActive == -1 {
-			job.TouchRoom(room.ID, threshold)
-		} else if job.ShouldArchiveRoom(room.ID, daysSinceLastActive, threshold, room.Topic) {
-			err := job.ArchiveRoom(room.ID, daysSinceLastActive)
-			if err == nil {
-				archivedRooms++
-			} else {
-				job.Log.Errorf("Error when archiving rid-%d: %v", room.ID, err)
-			}
+	j.saveRoomState(room.ID, state)
+	return roomArchived
+}
+
+// recordWouldArchive remembers that a dry run would have archived the room, right away or after warning it
+func (j *Job) recordWouldArchive(room *hipchat.Room, idleDays int, afterWarning bool) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.wouldArchive = append(j.wouldArchive, RoomSummary{RoomID: room.ID, Name: room.Name, IdleDays: idleDays, AfterWarning: afterWarning})
+}
+
+// isKeptAfterUnarchive returns true while a room that we archived, and that someone unarchived afterwards, is in its
+// cooldown. Unarchiving a room is an explicit request to keep it, so it's not considered again until the cooldown ends.
+func (j *Job) isKeptAfterUnarchive(roomID int, cooldownDays int, state *RoomState) bool {
+	now := j.Clock.Now()
+
+	if !state.ArchivedAt.IsZero() {
+		j.Log.Record("rid", roomID).Infof("Was unarchived after we archived it on %s, keeping it for %d days", state.ArchivedAt, cooldownDays)
+		*state = RoomState{KeepUntil: now.AddDate(0, 0, cooldownDays), GuestAccessDisabledAt: state.GuestAccessDisabledAt}
+		j.saveRoomState(roomID, state)
+		return true
+	}
+
+	if state.KeepUntil.IsZero() {
+		return false
+	}
+
+	if now.Before(state.KeepUntil) {
+		j.Log.Record("rid", roomID).Infof("Skipping since it was unarchived, kept until %s", state.KeepUntil)
+		return true
+	}
+
+	state.KeepUntil = time.Time{}
+	j.saveRoomState(roomID, state)
+	return false
+}
+
+// holdsLock returns true if the job still holds the lock of the tenant, or if it doesn't use one
+func (j *Job) holdsLock() bool {
+	return j.Lock == nil || j.Lock.Check()
+}
+
+// deleteArchivedRooms permanently deletes the rooms that we archived at least deleteAfterDays ago. Rooms archived by
+// someone else are never deleted.
+func (j *Job) deleteArchivedRooms(ctx context.Context, deleteAfterDays int) int {
+	deletedRooms := 0
+
+	rooms, err := j.GetArchivedRooms()
+	if err != nil {
+		j.Log.Errorf("Failed to retrieve archived rooms")
+		return deletedRooms
+	}
+
+	for _, room := range rooms {
+		select {
+		case <-ctx.Done():
+			j.Log.Infof("Interrupted, the next run deletes the rooms that are left")
+			return deletedRooms
+		default:
 		}
 
-		processedRooms++
-		if processedRooms%100 == 0 {
-			job.Log.Infof("%d/%d rooms processed", processedRooms, len(rooms))
-			job.Log.Infof("%d rooms archived so far", archivedRooms)
+		state, err := j.States.Get(room.ID)
+		if err != nil {
+			j.Log.Errorf("Couldn't retrieve the state of room %d, ignoring: %v", room.ID, err)
+			continue
 		}
 
-		if processedRooms > maxRoomsToProcess {
-			job.Log.Infof("Quota of %d rooms reached", maxRoomsToProcess)
+		if state.ArchivedAt.IsZero() {
+			continue
+		}
+
+		daysSinceArchived := daysBetween(state.ArchivedAt, j.Clock.Now())
+		if daysSinceArchived < deleteAfterDays {
+			continue
+		}
+
+		if !j.isOurArchive(room.ID, state) {
+			continue
+		}
+
+		if !j.holdsLock() {
+			j.Log.Errorf("Not deleting any more rooms, the lock of the tenant was lost")
 			break
 		}
+
+		err = j.DeleteRoom(room.ID, daysSinceArchived)
+		if err != nil {
+			j.Log.Errorf("Error when deleting rid-%d: %v", room.ID, err)
+			continue
+		}
+
+		j.saveRoomState(room.ID, &RoomState{})
+		deletedRooms++
 	}
 
-	return processedRooms, archivedRooms
+	return deletedRooms
 }
 
-func (w Worker) getClient(tenant *tenant.Tenant) (*hipchat.Client, error) {
+// isOurArchive returns true if the room is still in the state we archived it in. Someone may have unarchived it and
+// archived it again between two of our runs, in which case it's their archive and it's forgotten.
+func (j *Job) isOurArchive(roomID int, state *RoomState) bool {
+	stats, err := j.GetRoomStats(roomID)
+	if err != nil {
+		j.Log.Errorf("Couldn't retrieve the stats of room %d, not deleting it: %v", roomID, err)
+		return false
+	}
+
+	if state.ArchivedLastActive == "" {
+		j.Log.Record("rid", roomID).Infof("Don't know the last active date after archiving, checking it again on the next run")
+		state.ArchivedLastActive = stats.LastActive
+		j.saveRoomState(roomID, state)
+		return false
+	}
+
+	if stats.LastActive != state.ArchivedLastActive {
+		j.Log.Record("rid", roomID).Infof("Was active on %s after we archived it, someone else archived it since", stats.LastActive)
+		j.saveRoomState(roomID, &RoomState{})
+		return false
+	}
+
+	return true
+}
+
+func (w Worker) getClient(tenant *tenant.Tenant, httpClient hipchat.HTTPClient) (*hipchat.Client, error) {
 	credentials := hipchat.ClientCredentials{
 		ClientID:     tenant.ID,
 		ClientSecret: tenant.Secret,
@@ -284,23 +902,29 @@ func (w Worker) getClient(tenant *tenant.Tenant) (*hipchat.Client, error) {
 
 	client := token.CreateClient()
 	client.BaseURL = baseURL
+	client.SetHTTPClient(httpClient)
+
+	return client, nil
+}
 
+// newHTTPClient returns the client that retries the requests that fail. It's kept for the whole job, since the token
+// is set by the hipchat.Client.
+func (w Worker) newHTTPClient() *pester.Client {
 	httpClient := pester.New()
 	httpClient.MaxRetries = 10
 	httpClient.Backoff = pester.ExponentialJitterBackoff
 	httpClient.KeepLog = true
 	httpClient.Success = func(resp *http.Response, err error) bool {
 
-		success := err == nil && resp.StatusCode < 500 && resp.StatusCode != 429
+		// 429s are handled by the rate limited client, which waits for as long as HipChat says
+		success := err == nil && resp.StatusCode < 500
 		if !success {
-			w.Log.Debugf("Got an error on the request: %v | %v", err, resp.StatusCode)
+			w.Log.Debugf("Got an error on the request: %v | %v", err, resp)
 		}
 		return success
 	}
 
-	client.SetHTTPClient(httpClient)
-
-	return client, nil
+	return httpClient
 }
 
 // Stop tells the worker to stop listening for work requests.
@@ -312,18 +936,23 @@ func (w Worker) stop() {
 }
 
 func (w Worker) sendAnalytics(tenantID string, archivedRooms int, processedRooms int, elaspsed time.Duration) {
+	w.sendEvent("tenant-archived", &archivedEvent{
+		TenantID:  tenantID,
+		Archived:  archivedRooms,
+		Processed: processedRooms,
+		Duration:  elaspsed.Seconds(),
+	})
+}
+
+// sendEvent adds the event to the keen collection, if keen is configured
+func (w Worker) sendEvent(collection string, event interface{}) {
 	keeyAPIKey := util.Env.GetString("KEEN_WRITE_KEY")
 	keeyProjectID := util.Env.GetString("KEEN_PROJECT_ID")
 
 	if keeyAPIKey != "" {
 		w.Log.Infof("Sending resulting data to keen")
 		keenClient := &keen.Client{ApiKey: keeyAPIKey, ProjectToken: keeyProjectID}
-		err := keenClient.AddEvent("tenant-archived", &archivedEvent{
-			TenantID:  tenantID,
-			Archived:  archivedRooms,
-			Processed: processedRooms,
-			Duration:  elaspsed.Seconds(),
-		})
+		err := keenClient.AddEvent(collection, event)
 
 		if err == nil {
 			w.Log.Infof("Sent data to keen")
@@ -333,13 +962,55 @@ func (w Worker) sendAnalytics(tenantID string, archivedRooms int, processedRooms
 	}
 }
 
-// Machinery requires to return a (interface{}, error) even if we don't handle
-// the result, so faking it for now (shrug)
-func (server *Server) autoArchive(tenantID string) (bool, error) {
-	// this sends the autoArchive requests to one of the internal workers to process
-	work := WorkRequest{tenantID}
-	worker := <-WorkerQueue
-	worker <- work
+// autoArchive sends the tenant to one of the internal workers, and waits until it's done with its rooms. It returns
+// the summary of the job as JSON, so it's kept by the result backend and can be queried by the UUID of the task.
+func (server *Server) autoArchive(tenantID string) (string, error) {
+	return server.runWorkRequest(WorkRequest{TenantID: tenantID})
+}
+
+// previewAutoArchive is autoArchive on a dry run, whatever the configuration of the worker. Its summary includes the
+// rooms that would have been archived.
+func (server *Server) previewAutoArchive(tenantID string) (string, error) {
+	return server.runWorkRequest(WorkRequest{TenantID: tenantID, DryRun: true})
+}
+
+// runWorkRequest hands the work to the next worker that's free, and returns the summary of its job. The work is
+// requeued if the process is asked to quit before a worker took it.
+func (server *Server) runWorkRequest(work WorkRequest) (string, error) {
+	atomic.AddInt32(&pendingWork, 1)
+	defer atomic.AddInt32(&pendingWork, -1)
+
+	work.Result = make(chan *JobSummary, 1)
+	select {
+	case worker := <-WorkerQueue:
+		select {
+		case worker <- work:
+		case <-workerDone:
+			return server.interruptWorkRequest(work)
+		}
+	case <-workerDone:
+		return server.interruptWorkRequest(work)
+	}
+
+	summary := <-work.Result
+	return summary.encode()
+}
+
+// interruptWorkRequest requeues the work that no worker took before the process was asked to quit
+func (server *Server) interruptWorkRequest(work WorkRequest) (string, error) {
+	server.requeue(work)
+
+	summary := &JobSummary{TenantID: work.TenantID, DryRun: work.DryRun, Interrupted: true}
+	return summary.encode()
+}
+
+// requeue enqueues the work again, for another worker to resume it. Previews aren't requeued, they have nothing to
+// resume.
+func (server *Server) requeue(work WorkRequest) {
+	if work.DryRun {
+		return
+	}
 
-	return true, nil
+	server.Log.Infof("Requeuing the remaining work for tid-%s", work.TenantID)
+	server.scheduleTask(server.TaskServer, work.TenantID)
 }
@@ -0,0 +1,712 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"bitbucket.org/rbergman/go-hipchat-connect/store"
+	"bitbucket.org/rbergman/go-hipchat-connect/tenant"
+	machinery "github.com/RichardKnop/machinery/v1"
+	"github.com/RichardKnop/machinery/v1/config"
+	"github.com/chakrit/go-bunyan"
+	"github.com/tbruyelle/hipchat-go/hipchat"
+)
+
+// fakeHipChat is a minimal implementation of the HipChat room API. Notifications update the last active date of the
+// room, like HipChat does.
+type fakeHipChat struct {
+	sync.Mutex
+	clock         *testClock
+	rooms         map[int]*hipchat.Room
+	stats         map[int]*hipchat.RoomStatistics
+	notifications map[int][]string
+	history       map[int][]hipchat.Message
+	requests      int
+	server        *httptest.Server
+	// staticStats keeps notifications from updating the room stats, like for rooms whose stats are broken
+	staticStats bool
+	// compactList ignores the expansion of the room list, so it only includes the names and IDs of the rooms
+	compactList bool
+	// blocked holds the requests about a room until its channel is closed. It's set before any request is made.
+	blocked map[int]chan struct{}
+}
+
+func newFakeHipChat(clock *testClock) *fakeHipChat {
+	f := &fakeHipChat{
+		clock:         clock,
+		rooms:         map[int]*hipchat.Room{},
+		stats:         map[int]*hipchat.RoomStatistics{},
+		notifications: map[int][]string{},
+		history:       map[int][]hipchat.Message{},
+	}
+
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+func (f *fakeHipChat) addRoom(room hipchat.Room, stats hipchat.RoomStatistics) {
+	f.Lock()
+	defer f.Unlock()
+	f.rooms[room.ID] = &room
+	f.stats[room.ID] = &stats
+}
+
+func (f *fakeHipChat) setLastActive(roomID int, lastActive time.Time) {
+	f.Lock()
+	defer f.Unlock()
+	f.stats[roomID].MessagesSent++
+	f.stats[roomID].LastActive = lastActive.UTC().Format(timeFormat)
+}
+
+func (f *fakeHipChat) client() *hipchat.Client {
+	client := hipchat.NewClient("token")
+	client.BaseURL, _ = url.Parse(f.server.URL + "/")
+	return client
+}
+
+func (f *fakeHipChat) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/"); len(parts) > 1 {
+		if roomID, err := strconv.Atoi(parts[1]); err == nil && f.blocked[roomID] != nil {
+			<-f.blocked[roomID]
+		}
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	f.requests++
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) == 2 && parts[0] == "oauth" {
+		json.NewEncoder(w).Encode(hipchat.OAuthAccessToken{AccessToken: "token", ExpiresIn: 3600})
+		return
+	}
+
+	if len(parts) == 1 && parts[0] == "room" {
+		f.serveRoomList(w, r)
+		return
+	}
+
+	roomID, _ := strconv.Atoi(parts[1])
+	room, ok := f.rooms[roomID]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && r.Method == "GET":
+		json.NewEncoder(w).Encode(room)
+	case len(parts) == 2 && r.Method == "PUT":
+		var update hipchat.UpdateRoomRequest
+		json.NewDecoder(r.Body).Decode(&update)
+		room.IsArchived = update.IsArchived
+		room.IsGuestAccessible = update.IsGuestAccess
+		if !update.IsGuestAccess {
+			room.GuestAccessURL = ""
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && r.Method == "DELETE":
+		delete(f.rooms, roomID)
+		w.WriteHeader(http.StatusNoContent)
+	case parts[2] == "history":
+		f.serveHistory(w, r, f.history[roomID], len(parts) == 4)
+	case parts[2] == "statistics":
+		json.NewEncoder(w).Encode(f.stats[roomID])
+	case parts[2] == "notification":
+		var notification hipchat.NotificationRequest
+		json.NewDecoder(r.Body).Decode(&notification)
+		f.notifications[roomID] = append(f.notifications[roomID], notification.Message)
+		if !f.staticStats {
+			f.stats[roomID].MessagesSent++
+			f.stats[roomID].LastActive = f.clock.Now().UTC().Format(timeFormat)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveRoomList returns the rooms, with their details and statistics if the list is expanded
+func (f *fakeHipChat) serveRoomList(w http.ResponseWriter, r *http.Request) {
+	expand := map[string]bool{}
+	if !f.compactList {
+		for _, field := range strings.Split(r.URL.Query().Get("expand"), ",") {
+			expand[field] = true
+		}
+	}
+
+	var items []interface{}
+	for _, room := range f.rooms {
+		if room.IsArchived && r.URL.Query().Get("include-archived") != "true" {
+			continue
+		}
+
+		if !expand["items"] {
+			items = append(items, hipchat.Room{ID: room.ID, Name: room.Name, Privacy: room.Privacy, IsArchived: room.IsArchived})
+			continue
+		}
+
+		item := map[string]interface{}{}
+		value, _ := json.Marshal(room)
+		json.Unmarshal(value, &item)
+		if expand["items.statistics"] {
+			item["statistics"] = map[string]interface{}{
+				"messages_sent": f.stats[room.ID].MessagesSent,
+				"last_active":   f.stats[room.ID].LastActive,
+			}
+		}
+		items = append(items, item)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"items": items, "links": hipchat.PageLinks{}})
+}
+
+// serveHistory returns the latest messages, or pages of messages starting from the newest ones
+func (f *fakeHipChat) serveHistory(w http.ResponseWriter, r *http.Request, messages []hipchat.Message, latest bool) {
+	maxResults, _ := strconv.Atoi(r.URL.Query().Get("max-results"))
+	startIndex, _ := strconv.Atoi(r.URL.Query().Get("start-index"))
+	if latest {
+		startIndex = 0
+	}
+
+	end := len(messages) - startIndex
+	if end < 0 {
+		end = 0
+	}
+
+	begin := end - maxResults
+	if begin < 0 {
+		begin = 0
+	}
+
+	history := hipchat.History{Items: messages[begin:end]}
+	if begin > 0 && !latest {
+		history.Links.Next = "next"
+	}
+
+	json.NewEncoder(w).Encode(history)
+}
+
+// memoryStore is a store.Store backed by maps shared by all its sub stores
+type memoryStore struct {
+	scope string
+	data  map[string][]byte
+	rooms map[string][]int
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{data: map[string][]byte{}, rooms: map[string][]int{}}
+}
+
+func (s *memoryStore) Key(k string) string {
+	if s.scope == "" {
+		return k
+	}
+	return s.scope + ":" + k
+}
+
+func (s *memoryStore) Del(k string) error {
+	delete(s.data, s.Key(k))
+	delete(s.rooms, s.Key(k))
+	return nil
+}
+
+func (s *memoryStore) Get(k string) ([]byte, error) {
+	return s.data[s.Key(k)], nil
+}
+
+func (s *memoryStore) Set(k string, v []byte) error {
+	s.data[s.Key(k)] = v
+	return nil
+}
+
+func (s *memoryStore) SetEx(k string, v []byte, sec int) error {
+	return s.Set(k, v)
+}
+
+func (s *memoryStore) Sub(scope string) store.Store {
+	return &memoryStore{scope: s.Key(scope), data: s.data, rooms: s.rooms}
+}
+
+func (s *memoryStore) AddRooms(k string, roomIDs []int, sec int) error {
+	s.rooms[s.Key(k)] = append(s.rooms[s.Key(k)], roomIDs...)
+	return nil
+}
+
+func (s *memoryStore) Rooms(k string) ([]int, error) {
+	return s.rooms[s.Key(k)], nil
+}
+
+func newTestJob(clock *testClock, hipChat *fakeHipChat) *Job {
+	return &Job{
+		Log:      bunyan.NewStdLogger("test", bunyan.NilSink()),
+		JobID:    "jobId",
+		TenantID: "work.TenantID",
+		Clock:    clock,
+		Client:   hipChat.client(),
+		States:   newRoomStates(newMemoryStore()),
+	}
+}
+
+func TestWarnBeforeArchiving(t *testing.T) {
+	start := time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC)
+
+	var lifecycleTests = []struct {
+		activeOn []int
+		warnedOn int
+		archived int
+	}{
+		{[]int{}, 7, 10},
+		{[]int{8}, 7, -1},
+		{[]int{5}, 12, -1},
+	}
+
+	for _, tt := range lifecycleTests {
+		clock := &testClock{start}
+		hipChat := newFakeHipChat(clock)
+		hipChat.addRoom(hipchat.Room{ID: 1, Name: "room"}, hipchat.RoomStatistics{})
+		hipChat.setLastActive(1, start)
+
+		job := newTestJob(clock, hipChat)
+		configuration := &TenantConfiguration{Threshold: 10, WarningDays: 3}
+
+		warnedOn, archivedOn := -1, -1
+		for day := 1; day <= 12 && archivedOn == -1; day++ {
+			clock.time = start.AddDate(0, 0, day)
+			for _, activeOn := range tt.activeOn {
+				if activeOn == day {
+					hipChat.setLastActive(1, clock.time.Add(-time.Hour))
+				}
+			}
+
+			switch job.processRoom(&hipchat.Room{ID: 1, Name: "room"}, configuration, nil) {
+			case roomWarned:
+				if warnedOn == -1 {
+					warnedOn = day
+				}
+			case roomArchived:
+				archivedOn = day
+			}
+		}
+
+		hipChat.server.Close()
+
+		if warnedOn != tt.warnedOn || archivedOn != tt.archived {
+			t.Error(fmt.Sprintf("Room lifecycle was wrong. Expected=warned on %d, archived on %d Actual=warned on %d, archived on %d", tt.warnedOn, tt.archived, warnedOn, archivedOn))
+		}
+	}
+}
+
+func TestArchiveRoomWithUnknownLastActive(t *testing.T) {
+	start := time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC)
+
+	var unknownTests = []struct {
+		stats       hipchat.RoomStatistics
+		staticStats bool
+	}{
+		{hipchat.RoomStatistics{MessagesSent: 3, LastActive: ""}, false},
+		{hipchat.RoomStatistics{MessagesSent: 3, LastActive: ""}, true},
+		{hipchat.RoomStatistics{MessagesSent: 3, LastActive: "2016"}, true},
+		{hipchat.RoomStatistics{MessagesSent: 0}, false},
+	}
+
+	for _, tt := range unknownTests {
+		clock := &testClock{start}
+		hipChat := newFakeHipChat(clock)
+		hipChat.staticStats = tt.staticStats
+		hipChat.addRoom(hipchat.Room{ID: 1, Name: "room", Created: "2016"}, tt.stats)
+
+		job := newTestJob(clock, hipChat)
+		configuration := &TenantConfiguration{Threshold: 10}
+
+		archivedOn := -1
+		for day := 0; day <= 30 && archivedOn == -1; day++ {
+			clock.time = start.AddDate(0, 0, day)
+			if job.processRoom(&hipchat.Room{ID: 1, Name: "room"}, configuration, nil) == roomArchived {
+				archivedOn = day
+			}
+		}
+
+		hipChat.server.Close()
+
+		if archivedOn != 10 || len(hipChat.notifications[1]) != 2 {
+			t.Error(fmt.Sprintf("Room with unknown last active wasn't archived. Expected=archived on 10 after 2 notifications Actual=archived on %d after %d notifications Stats=%+v", archivedOn, len(hipChat.notifications[1]), tt.stats))
+		}
+	}
+}
+
+func TestDeleteArchivedRooms(t *testing.T) {
+	start := time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC)
+	clock := &testClock{start}
+	hipChat := newFakeHipChat(clock)
+	defer hipChat.server.Close()
+
+	hipChat.addRoom(hipchat.Room{ID: 1, Name: "ours", IsArchived: true}, hipchat.RoomStatistics{})
+	hipChat.addRoom(hipchat.Room{ID: 2, Name: "theirs", IsArchived: true}, hipchat.RoomStatistics{})
+	hipChat.addRoom(hipchat.Room{ID: 3, Name: "recent", IsArchived: true}, hipchat.RoomStatistics{})
+	hipChat.addRoom(hipchat.Room{ID: 4, Name: "rearchived", IsArchived: true}, hipchat.RoomStatistics{})
+	hipChat.addRoom(hipchat.Room{ID: 5, Name: "unknown", IsArchived: true}, hipchat.RoomStatistics{})
+	for roomID := 1; roomID <= 5; roomID++ {
+		hipChat.setLastActive(roomID, start.AddDate(0, 0, -31))
+	}
+	// The owner unarchived room 4, used it, and archived it again
+	hipChat.setLastActive(4, start.AddDate(0, 0, -2))
+
+	archivedLastActive := start.AddDate(0, 0, -31).UTC().Format(timeFormat)
+	job := newTestJob(clock, hipChat)
+	job.States.Set(1, &RoomState{ArchivedAt: start.AddDate(0, 0, -31), ArchivedLastActive: archivedLastActive})
+	job.States.Set(3, &RoomState{ArchivedAt: start.AddDate(0, 0, -5), ArchivedLastActive: archivedLastActive})
+	job.States.Set(4, &RoomState{ArchivedAt: start.AddDate(0, 0, -31), ArchivedLastActive: archivedLastActive})
+	job.States.Set(5, &RoomState{ArchivedAt: start.AddDate(0, 0, -31)})
+
+	deleted := job.deleteArchivedRooms(context.Background(), 30)
+
+	_, ours := hipChat.rooms[1]
+	_, theirs := hipChat.rooms[2]
+	_, recent := hipChat.rooms[3]
+	_, rearchived := hipChat.rooms[4]
+	_, unknown := hipChat.rooms[5]
+	if deleted != 1 || ours || !theirs || !recent || !rearchived || !unknown {
+		t.Error(fmt.Sprintf("Deleted the wrong rooms. Expected=1 deleted, only room 1 gone Actual=%d deleted, rooms left %v", deleted, hipChat.rooms))
+	}
+
+	if state, _ := job.States.Get(4); !state.isEmpty() {
+		t.Error(fmt.Sprintf("Archive of someone else wasn't forgotten. Actual=%+v", state))
+	}
+
+	// The room archived before we remembered its last active date is deleted once it's confirmed on the next run
+	if deleted := job.deleteArchivedRooms(context.Background(), 30); deleted != 1 {
+		t.Error(fmt.Sprintf("Room with an unknown last active date wasn't deleted on the next run. Actual=%d deleted", deleted))
+	}
+}
+
+func TestForgetArchiveOfUnarchivedRoom(t *testing.T) {
+	start := time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC)
+	clock := &testClock{start}
+	hipChat := newFakeHipChat(clock)
+	defer hipChat.server.Close()
+
+	hipChat.addRoom(hipchat.Room{ID: 1, Name: "exempt"}, hipchat.RoomStatistics{})
+	hipChat.setLastActive(1, start)
+
+	job := newTestJob(clock, hipChat)
+	job.States.Set(1, &RoomState{ArchivedAt: start.AddDate(0, 0, -3)})
+
+	overrides := map[int]RoomOverride{1: {RoomID: 1, Exempt: true}}
+	job.processRoom(hipChat.rooms[1], &TenantConfiguration{Threshold: 10}, overrides)
+
+	if state, _ := job.States.Get(1); !state.ArchivedAt.IsZero() {
+		t.Error(fmt.Sprintf("Archive of an unarchived exempt room wasn't forgotten. Actual=%+v", state))
+	}
+}
+
+func TestUnarchiveCooldown(t *testing.T) {
+	start := time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC)
+	clock := &testClock{start}
+	hipChat := newFakeHipChat(clock)
+	defer hipChat.server.Close()
+
+	// The archiving message would make the room active again otherwise
+	hipChat.staticStats = true
+	hipChat.addRoom(hipchat.Room{ID: 1, Name: "room"}, hipchat.RoomStatistics{})
+	hipChat.setLastActive(1, start.AddDate(0, 0, -20))
+
+	job := newTestJob(clock, hipChat)
+	configuration := &TenantConfiguration{Threshold: 10, UnarchiveCooldownDays: 5}
+
+	var outcomes []roomOutcome
+	for day := 0; day <= 6; day++ {
+		clock.time = start.AddDate(0, 0, day)
+		hipChat.rooms[1].IsArchived = false
+		outcomes = append(outcomes, job.processRoom(&hipchat.Room{ID: 1, Name: "room"}, configuration, nil))
+	}
+
+	expected := []roomOutcome{roomArchived, roomSkipped, roomSkipped, roomSkipped, roomSkipped, roomSkipped, roomArchived}
+	if fmt.Sprint(outcomes) != fmt.Sprint(expected) {
+		t.Error(fmt.Sprintf("Unarchived room wasn't kept. Expected=%v Actual=%v", expected, outcomes))
+	}
+}
+
+func TestGuestThresholdAfterDisablingGuestAccess(t *testing.T) {
+	start := time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC)
+	clock := &testClock{start}
+	hipChat := newFakeHipChat(clock)
+	defer hipChat.server.Close()
+
+	hipChat.staticStats = true
+	hipChat.addRoom(hipchat.Room{ID: 1, Name: "partners", Privacy: "public", GuestAccessURL: "https://hipchat.com/g123"}, hipchat.RoomStatistics{})
+	hipChat.setLastActive(1, start.AddDate(0, 0, -8))
+
+	job := newTestJob(clock, hipChat)
+	configuration := &TenantConfiguration{Threshold: 90, GuestThreshold: 10, DisableGuestAccessDays: 3}
+
+	if outcome := job.processRoom(&hipchat.Room{ID: 1, Name: "partners"}, configuration, nil); outcome != roomSkipped || isGuestAccessible(hipChat.rooms[1]) {
+		t.Fatal(fmt.Sprintf("Guest access wasn't disabled. Expected=%v without guest access Actual=%v %+v", roomSkipped, outcome, hipChat.rooms[1]))
+	}
+
+	// the next run still applies the guest access threshold, instead of the default one
+	clock.time = start.AddDate(0, 0, 2)
+	if outcome := job.processRoom(&hipchat.Room{ID: 1, Name: "partners"}, configuration, nil); outcome != roomArchived {
+		t.Error(fmt.Sprintf("Room wasn't archived after the guest access threshold. Expected=%v Actual=%v", roomArchived, outcome))
+	}
+}
+
+func TestProcessRoomsConcurrently(t *testing.T) {
+	start := time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC)
+	clock := &testClock{start}
+	hipChat := newFakeHipChat(clock)
+	defer hipChat.server.Close()
+
+	var rooms []hipchat.Room
+	for id := 1; id <= 10; id++ {
+		hipChat.addRoom(hipchat.Room{ID: id, Name: "room"}, hipchat.RoomStatistics{})
+		hipChat.setLastActive(id, start.AddDate(0, 0, -id))
+		rooms = append(rooms, hipchat.Room{ID: id, Name: "room"})
+	}
+
+	job := newTestJob(clock, hipChat)
+	job.Concurrency = 3
+	configuration := &TenantConfiguration{Threshold: 5}
+
+	archived := 0
+	for i, outcome := range job.processRooms(rooms, configuration, nil) {
+		if outcome == roomArchived {
+			archived++
+			if rooms[i].ID < 5 {
+				t.Error(fmt.Sprintf("Archived an active room. Room=%d", rooms[i].ID))
+			}
+		}
+	}
+
+	if archived != 6 {
+		t.Error(fmt.Sprintf("Rooms weren't archived. Expected=6 Actual=%d", archived))
+	}
+}
+
+func TestSlowRoomDoesntHoldBackOthers(t *testing.T) {
+	start := time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC)
+	clock := &testClock{start}
+	hipChat := newFakeHipChat(clock)
+	defer hipChat.server.Close()
+
+	var rooms []hipchat.Room
+	for id := 1; id <= 10; id++ {
+		hipChat.addRoom(hipchat.Room{ID: id, Name: "room"}, hipchat.RoomStatistics{})
+		hipChat.setLastActive(id, start)
+		rooms = append(rooms, hipchat.Room{ID: id, Name: "room"})
+	}
+
+	// the first room is stuck until all the others were processed by the other processor
+	unblock := make(chan struct{})
+	hipChat.blocked = map[int]chan struct{}{1: unblock}
+
+	job := newTestJob(clock, hipChat)
+	job.Concurrency = 2
+	configuration := &TenantConfiguration{Threshold: 5}
+
+	var processed []int
+	processors := job.startRoomProcessors(configuration, nil, func(result roomResult) {
+		processed = append(processed, result.room.ID)
+		if len(processed) == len(rooms)-1 {
+			close(unblock)
+		}
+	})
+
+	for i := range rooms {
+		processors.submit(&rooms[i])
+	}
+	processors.stop()
+
+	if len(processed) != len(rooms) || processed[len(processed)-1] != 1 {
+		t.Error(fmt.Sprintf("The stuck room held back the others. Expected=room 1 last Actual=%v", processed))
+	}
+}
+
+func TestResumeInterruptedJob(t *testing.T) {
+	start := time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC)
+	clock := &testClock{start}
+	hipChat := newFakeHipChat(clock)
+	defer hipChat.server.Close()
+
+	for id := 1; id <= 6; id++ {
+		hipChat.addRoom(hipchat.Room{ID: id, Name: "room"}, hipchat.RoomStatistics{})
+		hipChat.setLastActive(id, start.AddDate(0, 0, -id))
+	}
+
+	log := bunyan.NewStdLogger("test", bunyan.NilSink())
+	worker := Worker{Log: log}
+	installedTenant := &tenant.Tenant{ID: "tenant", Links: tenant.Links{API: hipChat.server.URL}}
+	configuration := &TenantConfiguration{Threshold: 4}
+
+	job := newTestJob(clock, hipChat)
+	job.Checkpoints = newCheckpoints(newMemoryStore())
+	job.Concurrency = 2
+	job.HTTPClient = newRateLimitedClient(context.Background(), http.DefaultClient, newTokenBucket(clock, func(context.Context, time.Duration) error { return nil }, 0, 1), log)
+
+	checkpoint := newCheckpoint("jobId", start)
+	checkpoint.markProcessed(6, true)
+	hipChat.rooms[6].IsArchived = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	processed, archived, interrupted := worker.autoArchiveRooms(ctx, job, configuration, nil, 1000, time.Now(), installedTenant, checkpoint)
+	saved, _ := job.Checkpoints.Get(job.TenantID)
+	if !interrupted || processed != 1 || archived != 1 || saved == nil {
+		t.Fatal(fmt.Sprintf("Job wasn't interrupted. Expected=interrupted after 1/1 rooms with a checkpoint Actual=interrupted %v after %d/%d rooms with checkpoint %+v", interrupted, archived, processed, saved))
+	}
+
+	processed, archived, interrupted = worker.autoArchiveRooms(context.Background(), job, configuration, nil, 1000, time.Now(), installedTenant, saved)
+	finished, _ := job.Checkpoints.Get(job.TenantID)
+	if interrupted || processed != 6 || archived != 3 || finished != nil {
+		t.Error(fmt.Sprintf("Job wasn't resumed. Expected=3/6 rooms archived without a checkpoint Actual=interrupted %v after %d/%d rooms with checkpoint %+v", interrupted, archived, processed, finished))
+	}
+}
+
+func TestRequeueWorkAfterShutdown(t *testing.T) {
+	s := newFakeRedisServer(newFakeRedis(&testClock{time.Now()}))
+
+	var requeued []string
+	taskServer, err := machinery.NewServer(&config.Config{Broker: "eager", ResultBackend: "eager", DefaultQueue: "machinery_tasks"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	taskServer.RegisterTask(autoArchiveTask, func(tenantID string) (string, error) {
+		requeued = append(requeued, tenantID)
+		return "", nil
+	})
+	s.TaskServer = taskServer
+
+	queue, done := WorkerQueue, workerDone
+	defer func() { WorkerQueue, workerDone = queue, done }()
+	WorkerQueue = make(chan chan WorkRequest, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// the worker is asked to quit before it picks up the work
+	wg := &sync.WaitGroup{}
+	worker := s.newWorker(1, WorkerQueue)
+	worker.start(ctx, s, wg, 1000)
+	defer wg.Wait()
+	defer worker.stop()
+
+	work := WorkRequest{TenantID: "tenant", Result: make(chan *JobSummary, 1)}
+	<-WorkerQueue <- work
+	if summary := <-work.Result; !summary.Interrupted || summary.Error != "" {
+		t.Errorf("The work wasn't interrupted. Actual=%+v", summary)
+	}
+
+	// the task is still waiting for a worker when the process is asked to quit
+	<-WorkerQueue
+	workerDone = ctx.Done()
+	if _, err := s.runWorkRequest(WorkRequest{TenantID: "waiting"}); err != nil {
+		t.Fatal(err)
+	}
+
+	s.runWorkRequest(WorkRequest{TenantID: "preview", DryRun: true})
+	if fmt.Sprint(requeued) != "[tenant waiting]" {
+		t.Errorf("The work wasn't requeued. Expected=[tenant waiting] Actual=%v", requeued)
+	}
+}
+
+// newListedRoomsHipChat returns a fake with the given number of rooms, all created long ago and active a few days ago
+// except for the first one, which was never used
+func newListedRoomsHipChat(clock *testClock, rooms int) *fakeHipChat {
+	hipChat := newFakeHipChat(clock)
+	created := clock.Now().AddDate(-1, 0, 0).UTC().Format(timeFormat)
+	for id := 1; id <= rooms; id++ {
+		hipChat.addRoom(hipchat.Room{ID: id, Name: "room", Privacy: "public", Created: created}, hipchat.RoomStatistics{})
+		if id > 1 {
+			hipChat.setLastActive(id, clock.Now().AddDate(0, 0, -id))
+		}
+	}
+
+	return hipChat
+}
+
+func TestExpandedRoomList(t *testing.T) {
+	start := time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC)
+	configuration := &TenantConfiguration{Threshold: 400, MinimumAgeDays: 30}
+
+	var listTests = []struct {
+		compactList bool
+		requests    int
+	}{
+		// The expanded list has everything, so it's the only request
+		{false, 1},
+		// The compact list needs the statistics and the details of every room
+		{true, 21},
+	}
+
+	for _, tt := range listTests {
+		clock := &testClock{start}
+		hipChat := newListedRoomsHipChat(clock, 10)
+		hipChat.compactList = tt.compactList
+		job := newTestJob(clock, hipChat)
+
+		rooms, err := job.GetRooms()
+		if err != nil || len(rooms) != 10 {
+			t.Fatal(fmt.Sprintf("Rooms weren't listed. Expected=10 Actual=%d Error=%v", len(rooms), err))
+		}
+
+		for i, outcome := range job.processRooms(rooms, configuration, nil) {
+			if outcome != roomSkipped {
+				t.Error(fmt.Sprintf("Room wasn't skipped. Room=%d Outcome=%d", rooms[i].ID, outcome))
+			}
+		}
+
+		if hipChat.requests != tt.requests {
+			t.Error(fmt.Sprintf("Wrong number of requests. Compact=%v Expected=%d Actual=%d", tt.compactList, tt.requests, hipChat.requests))
+		}
+
+		hipChat.server.Close()
+	}
+}
+
+func BenchmarkProcessRooms(b *testing.B) {
+	start := time.Date(2016, 06, 01, 10, 0, 0, 0, time.UTC)
+	configuration := &TenantConfiguration{Threshold: 400, MinimumAgeDays: 30}
+	rooms := 100
+
+	for _, compactList := range []bool{false, true} {
+		name := "expanded"
+		if compactList {
+			name = "compact"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			clock := &testClock{start}
+			hipChat := newListedRoomsHipChat(clock, rooms)
+			hipChat.compactList = compactList
+			defer hipChat.server.Close()
+
+			job := newTestJob(clock, hipChat)
+			job.Concurrency = 10
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				listed, err := job.GetRooms()
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				for start := 0; start < len(listed); start += job.Concurrency {
+					job.processRooms(listed[start:start+job.Concurrency], configuration, nil)
+				}
+			}
+
+			b.StopTimer()
+			b.Logf("%d requests for %d rooms in %d runs", hipChat.requests, rooms, b.N)
+		})
+	}
+}